@@ -56,3 +56,99 @@ def get_status(jobid, sockname=DEFAULT_SOCKET_PATH):
             raise ServerError(resp[1])
     finally:
         sock.close()
+
+def cancel_job(jobid, sockname=DEFAULT_SOCKET_PATH):
+    reqObj = {
+        'Op': 'cancel',
+        'Id': jobid
+    }
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.connect(sockname)
+    f = sock.makefile()
+    try:
+        f.write(json.dumps(reqObj))
+        f.flush()
+        resp = json.load(f)
+
+        if resp[0] == 'OK':
+            return resp[1]
+        else:
+            raise ServerError(resp[1])
+    finally:
+        sock.close()
+
+def list_jobs(states=None, score=None, player=None, since=None, until=None,
+              cursor=None, limit=None, sockname=DEFAULT_SOCKET_PATH):
+    reqObj = {
+        'Op': 'list',
+    }
+    if states is not None:
+        reqObj['States'] = list(states)
+    if score is not None:
+        reqObj['Score'] = score
+    if player is not None:
+        reqObj['Player'] = player
+    if since is not None:
+        reqObj['Since'] = int(since)
+    if until is not None:
+        reqObj['Until'] = int(until)
+    if cursor is not None:
+        reqObj['Cursor'] = cursor
+    if limit is not None:
+        reqObj['Limit'] = limit
+
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.connect(sockname)
+    f = sock.makefile()
+    try:
+        f.write(json.dumps(reqObj))
+        f.flush()
+        resp = json.load(f)
+
+        if resp[0] == 'OK':
+            return resp[1]
+        else:
+            raise ServerError(resp[1])
+    finally:
+        sock.close()
+
+def wait_job(jobid, timeout=None, sockname=DEFAULT_SOCKET_PATH):
+    reqObj = {
+        'Op': 'wait',
+        'Id': jobid
+    }
+    if timeout is not None:
+        reqObj['Timeout'] = int(timeout)
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.connect(sockname)
+    f = sock.makefile()
+    try:
+        f.write(json.dumps(reqObj))
+        f.flush()
+        resp = json.load(f)
+
+        if resp[0] == 'OK':
+            return resp[1]
+        else:
+            raise ServerError(resp[1])
+    finally:
+        sock.close()
+
+def watch_job(jobid, sockname=DEFAULT_SOCKET_PATH):
+    reqObj = {
+        'Op': 'watch',
+        'Id': jobid
+    }
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.connect(sockname)
+    f = sock.makefile()
+    try:
+        f.write(json.dumps(reqObj))
+        f.flush()
+        resp = json.loads(f.readline())
+        if resp[0] != 'OK':
+            raise ServerError(resp[1])
+        for line in f:
+            yield json.loads(line)
+    finally:
+        sock.close()
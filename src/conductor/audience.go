@@ -4,12 +4,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
 	"json"
 	"net"
 	"os"
 	o "orchestra"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type GenericJsonRequest struct {
@@ -19,18 +23,208 @@ type GenericJsonRequest struct {
 	Scope		*string
 	Params		map[string]string
 	Id		*uint64
+	// list filters
+	States		[]string
+	Player		*string
+	Since		*int64
+	Until		*int64
+	Cursor		*uint64
+	Limit		*int
+	// wait timeout, in seconds.
+	Timeout		*int64
+	// rolling execution - a count or percentage of the players to
+	// run at a time, and how many failures to tolerate.
+	Batch		*string
+	FailureBudget	*int
+	// higher runs first.  Defaults to 0.
+	Priority	*int
+	// don't start the job before this time (seconds since the epoch).
+	NotBefore	*int64
+	// for recurring schedules.
+	Cron		*string
+	// jobs that must finish first, and how they must finish.
+	DependsOn	[]uint64
+	Condition	*string
+	// the workflow to run.
+	Workflow	*string
+	// how long the score may run for, in seconds.
+	RunTimeout	*int
 }
 
 type JsonPlayerStatus struct {
 	Status		string
 	Response	map[string]string
+	// the end of the score's output.
+	Stdout		string
+	Stderr		string
 }
 
 type JsonStatusResponse struct {
 	Status		string
+	Submitter	string
+	// the players, groups and tags that were asked for, and the
+	// players they turned out to be.
+	Requested	[]string
+	Targets		[]string
+	DependsOn	[]uint64
 	Players		map[string]*JsonPlayerStatus
 }
 
+type JsonJobEvent struct {
+	Id		uint64
+	// "" for changes to the job's aggregate status.
+	Player		string
+	Status		string
+	Response	map[string]string
+}
+
+type JsonJobSummary struct {
+	Id		uint64
+	Score		string
+	Scope		string
+	Players		[]string
+	Status		string
+	Submitter	string
+	Priority	int
+	NotBefore	int64
+	Created		int64
+	Finished	int64
+}
+
+type JsonStepStatus struct {
+	Status		string
+	// 0 if the step hasn't been started.
+	Job		uint64
+	Reason		string
+}
+
+type JsonWorkflowStatus struct {
+	Id		uint64
+	Workflow	string
+	Status		string
+	Submitter	string
+	Created		int64
+	Finished	int64
+	Steps		map[string]*JsonStepStatus
+}
+
+type JsonListResponse struct {
+	Jobs		[]*JsonJobSummary
+	// the cursor to use to get the next page, if there is one.
+	Next		*uint64
+}
+
+const (
+	DefaultListLimit	= 100
+	MaximumListLimit	= 1000
+)
+
+var jobStateNames = map[int]string {
+	o.JOB_PENDING:		"PENDING",
+	o.JOB_SUCCESSFUL:	"OK",
+	o.JOB_FAILED_PARTIAL:	"PARTIAL_FAIL",
+	o.JOB_FAILED:		"FAIL",
+	o.JOB_CANCELLED:	"CANCELLED",
+	o.JOB_FAILED_DEPENDENCY:	"DEPENDENCY_FAIL",
+}
+
+var scopeNames = map[int]string {
+	o.SCOPE_ONEOF:		"one",
+	o.SCOPE_ALLOF:		"all",
+	o.SCOPE_ANYOF:		"any",
+	o.SCOPE_QUORUM:		"quorum",
+}
+
+var taskStateNames = map[int]string {
+	o.RESP_RUNNING:			"PENDING",
+	o.RESP_FINISHED:		"OK",
+	o.RESP_FAILED:			"FAIL",
+	o.RESP_FAILED_UNKNOWN_SCORE:	"UNK_SCORE",
+	o.RESP_FAILED_HOST_ERROR:	"HOST_ERROR",
+	o.RESP_FAILED_UNKNOWN:		"UNKNOWN_FAILURE",
+	o.RESP_CANCELLED:		"CANCELLED",
+	o.RESP_SKIPPED:			"SKIPPED",
+	o.RESP_TIMED_OUT:		"TIMED_OUT",
+	o.RESP_INVALID_PARAMS:		"INVALID_PARAMS",
+}
+
+// an unknown state is a bug, but not one worth taking the conductor
+// down over.
+func jobStateName(state int) string {
+	name, exists := jobStateNames[state]
+	if !exists {
+		o.Warn("%d is an unknown job state!", state)
+		return "UNKNOWN"
+	}
+	return name
+}
+
+func taskStateName(state int) string {
+	name, exists := taskStateNames[state]
+	if !exists {
+		o.Warn("%d is an unknown task state!", state)
+		return "UNKNOWN"
+	}
+	return name
+}
+
+func jobStateFromName(name string) (state int, ok bool) {
+	for k, v := range jobStateNames {
+		if v == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+func NewJsonJobSummary(job *o.JobRequest) (js *JsonJobSummary) {
+	js = new(JsonJobSummary)
+	js.Id = job.Id
+	js.Score = job.Score
+	js.Scope = scopeName(job)
+	js.Players = job.Targets
+	js.Status = jobStateName(job.State)
+	js.Submitter = job.Submitter
+	js.Priority = job.Priority
+	js.NotBefore = job.NotBefore / 1e9
+	js.Created = job.Created / 1e9
+	js.Finished = job.Finished / 1e9
+
+	return js
+}
+
+func NewJsonWorkflowStatus(run *WorkflowRun) (jws *JsonWorkflowStatus) {
+	jws = new(JsonWorkflowStatus)
+	jws.Id = run.Id
+	jws.Workflow = run.Workflow
+	jws.Status = run.Status
+	jws.Submitter = run.Submitter
+	jws.Created = run.Created
+	jws.Finished = run.Finished
+	jws.Steps = make(map[string]*JsonStepStatus)
+	for name, sr := range run.Steps {
+		jss := new(JsonStepStatus)
+		jss.Status = sr.Status
+		jss.Job = sr.Job
+		jss.Reason = sr.Reason
+		jws.Steps[name] = jss
+	}
+
+	return jws
+}
+
+func NewJsonPlayerStatusFromResult(tr *o.TaskResponse) (jps *JsonPlayerStatus) {
+	jps = NewJsonPlayerStatus()
+	jps.Status = taskStateName(tr.State)
+	for k,v:=range(tr.Response) {
+		jps.Response[k] = v
+	}
+	jps.Stdout = tr.Stdout
+	jps.Stderr = tr.Stderr
+
+	return jps
+}
+
 func NewJsonStatusResponse() (jsr *JsonStatusResponse) {
 	jsr = new(JsonStatusResponse)
 	jsr.Players = make(map[string]*JsonPlayerStatus)
@@ -45,7 +239,9 @@ func NewJsonPlayerStatus() (jps *JsonPlayerStatus) {
 	return jps	
 }
 
-func handleAudienceRequest(c net.Conn) {
+// who is the identity of the peer, or nil if we don't know who they
+// are.
+func handleAudienceRequest(c net.Conn, who *Identity) {
 	defer c.Close()
 
 	c.SetTimeout(0)
@@ -54,121 +250,556 @@ func handleAudienceRequest(c net.Conn) {
 	dec := json.NewDecoder(r)
 	enc := json.NewEncoder(w)
 
+	// everything gets audited, even the garbage.
+	var op string
+	var auditId uint64 = 0
+	result := "OK"
 	outobj := new(GenericJsonRequest)
+	defer func() {
+		AuditRequest(who, peerName(c), op, outobj, auditId, result)
+	}()
+	fail := func(reason string) {
+		result = reason
+		sendQueueFailureResponse(reason, enc)
+	}
+
 	err := dec.Decode(outobj)
 	if err != nil {
 		o.Warn("Error decoding JSON talking to audience: %s", err)
+		outobj = nil
+		result = "Malformed Request"
 		return
 	}
 
 	if nil == outobj.Op {
 		o.Warn("Malformed JSON message talking to audience.  Missing Op")
+		result = "Missing Op"
 		return
 	}
-	switch *(outobj.Op) {
+	op = *(outobj.Op)
+	switch op {
 	case "status":
 		if nil == outobj.Id {
 			o.Warn("Malformed Status message talking to audience. Missing Job ID")
+			result = "Missing Job ID"
 			return
 		}
-		job := o.JobGet(*outobj.Id)
-		jresp := new([2]interface{})
-		if nil != job {
-			jresp[0] = "OK"
-			iresp := NewJsonStatusResponse()
-			switch job.State {
-			case o.JOB_PENDING:
-				iresp.Status = "PENDING"
-			case o.JOB_SUCCESSFUL:
-				iresp.Status = "OK"
-			case o.JOB_FAILED_PARTIAL:
-				iresp.Status = "PARTIAL_FAIL"
-			case o.JOB_FAILED:
-				iresp.Status = "FAIL"
-			default:
-				o.Fail("Blargh.  %d is an unknown job state!", job.State)
-			}
-			resnames := o.JobGetResultNames(*outobj.Id)
-			for i := range resnames {
-				tr := o.JobGetResult(*outobj.Id, resnames[i])
-				if nil != tr {
-					presp := NewJsonPlayerStatus()
-					switch tr.State {
-					case o.RESP_RUNNING:
-						presp.Status = "PENDING"
-					case o.RESP_FINISHED:
-						presp.Status = "OK"
-					case o.RESP_FAILED:
-						presp.Status = "FAIL"
-					case o.RESP_FAILED_UNKNOWN_SCORE:
-						presp.Status = "UNK_SCORE"
-					case o.RESP_FAILED_HOST_ERROR:
-						presp.Status = "HOST_ERROR"
-					case o.RESP_FAILED_UNKNOWN:
-						presp.Status = "UNKNOWN_FAILURE"
-					}
-					for k,v:=range(tr.Response) {
-						presp.Response[k] = v
-					}
-					iresp.Players[resnames[i]] = presp
-				}
-		
-			}
-			jresp[1] = iresp
-		} else {
-			jresp[0] = "Error"
-			jresp[1] = nil
-		}
+		jresp := jobStatusResponse(*outobj.Id)
+		result = statusResult(jresp)
 		enc.Encode(jresp)
 		o.Debug("Status...")
+	case "wait":
+		if nil == outobj.Id {
+			o.Warn("Malformed Wait message talking to audience. Missing Job ID")
+			fail("Missing Job ID")
+			return
+		}
+		var timeout int64 = 0
+		if nil != outobj.Timeout {
+			timeout = *outobj.Timeout
+		}
+		waitForJob(*outobj.Id, timeout)
+		jresp := jobStatusResponse(*outobj.Id)
+		result = statusResult(jresp)
+		enc.Encode(jresp)
+	case "watch":
+		if nil == outobj.Id {
+			o.Warn("Malformed Watch message talking to audience. Missing Job ID")
+			fail("Missing Job ID")
+			return
+		}
+		watchJob(*outobj.Id, enc)
 	case "queue":
-		if nil == outobj.Score {
-			o.Warn("Malformed Queue message talking to audience. Missing Score")
-			sendQueueFailureResponse("Missing Score", enc)
+		job, reason := outobj.MakeJob()
+		if nil == job {
+			fail(reason)
+			return
+		}
+		if !JobPermitted(who, job) {
+			fail("Forbidden")
 			return
 		}
-		if nil == outobj.Scope {
-			o.Warn("Malformed Queue message talking to audience. Missing Scope")
-			sendQueueFailureResponse("Missing Scope", enc)
+		job.Submitter = who.String()
+		QueueJob(job)
+		auditId = job.Id
+		sendQueueSuccessResponse(job, enc)
+	case "cancel":
+		if nil == outobj.Id {
+			o.Warn("Malformed Cancel message talking to audience. Missing Job ID")
+			fail("Missing Job ID")
 			return
 		}
-		if nil == outobj.Players || len(outobj.Players) < 1 {
-			o.Warn("Malformed Queue message talking to audience. Missing Players")
-			sendQueueFailureResponse("Missing Players", enc)
+		job := o.JobGet(*outobj.Id)
+		if nil != job && !JobPermitted(who, job) {
+			fail("Forbidden")
 			return
 		}
-		for _, player := range outobj.Players {
-			if !HostAuthorised(player) {
-				o.Warn("Malformed Queue message - unknown player %s specified.", player)
-				sendQueueFailureResponse("Invalid Player", enc)
-				return
-			}
+		ok, reason := CancelJob(*outobj.Id)
+		if !ok {
+			fail(reason)
+			return
+		}
+		sendIdSuccessResponse(*outobj.Id, enc)
+	case "schedule":
+		if nil == outobj.Cron {
+			o.Warn("Malformed Schedule message talking to audience. Missing Cron")
+			fail("Missing Cron")
+			return
+		}
+		spec, err := ParseCron(*outobj.Cron)
+		if err != nil {
+			o.Warn("Bad cron spec \"%s\" from audience: %s", *outobj.Cron, err)
+			fail("Invalid Cron")
+			return
+		}
+		if spec.Next(time.Seconds()) == 0 {
+			fail("Invalid Cron")
+			return
+		}
+		// make sure the job makes sense now, rather than finding
+		// out when it fires.
+		job, reason := outobj.MakeJob()
+		if nil == job {
+			fail(reason)
+			return
+		}
+		if !JobPermitted(who, job) {
+			fail("Forbidden")
+			return
+		}
+		auditId = AddSchedule(*outobj.Cron, spec, outobj, who.String())
+		sendIdSuccessResponse(auditId, enc)
+	case "schedules":
+		jresp := new([2]interface{})
+		jresp[0] = "OK"
+		jresp[1] = ListSchedules(who)
+		enc.Encode(jresp)
+	case "unschedule":
+		if nil == outobj.Id {
+			o.Warn("Malformed Unschedule message talking to audience. Missing Schedule ID")
+			fail("Missing Schedule ID")
+			return
+		}
+		sched := GetSchedule(*outobj.Id)
+		if nil == sched {
+			fail("Unknown Schedule")
+			return
+		}
+		if !schedulePermitted(who, sched) {
+			fail("Forbidden")
+			return
+		}
+		if !RemoveSchedule(*outobj.Id) {
+			fail("Unknown Schedule")
+			return
+		}
+		sendIdSuccessResponse(*outobj.Id, enc)
+	case "workflow":
+		if nil == outobj.Workflow {
+			o.Warn("Malformed Workflow message talking to audience. Missing Workflow")
+			fail("Missing Workflow")
+			return
+		}
+		id, reason := StartWorkflow(*outobj.Workflow, outobj.Params, who)
+		if id == 0 {
+			fail(reason)
+			return
+		}
+		auditId = id
+		sendIdSuccessResponse(id, enc)
+	case "workflow_status":
+		if nil == outobj.Id {
+			o.Warn("Malformed Workflow Status message talking to audience. Missing Run ID")
+			fail("Missing Run ID")
+			return
+		}
+		run := GetWorkflowRun(*outobj.Id)
+		if nil == run {
+			fail("Unknown Run")
+			return
 		}
-		job := NewRequest()
-		job.Score = *outobj.Score
-		switch (*outobj.Scope) {
-		case "one":
-			job.Scope = o.SCOPE_ONEOF
-		case "all":
-			job.Scope = o.SCOPE_ALLOF
-		default:
-			sendQueueFailureResponse("Invalid Scope", enc)
+		if !WorkflowRunPermitted(who, run) {
+			fail("Forbidden")
 			return
 		}
-		job.Players = outobj.Players
-		job.Params = outobj.Params
+		jresp := new([2]interface{})
+		jresp[0] = "OK"
+		jresp[1] = NewJsonWorkflowStatus(run)
+		enc.Encode(jresp)
+	case "list":
+		filter, reason := outobj.MakeFilter()
+		if nil == filter {
+			fail(reason)
+			return
+		}
+		enc.Encode(jobListResponse(filter))
+	default:
+		o.Warn("Unknown operation talking to audience: \"%s\"", op)
+		result = "Unknown Op"
+		return
+	}
+}
 
-		QueueJob(job)
-		sendQueueSuccessResponse(job, enc)
+// where an audience connection came from, for the logs.
+func peerName(c net.Conn) string {
+	if _, ok := c.(*net.UnixConn); ok {
+		return "local"
+	}
+	return c.RemoteAddr().String()
+}
+
+// summarise a status response for the audit log.
+func statusResult(jresp *[2]interface{}) string {
+	if jresp[0] == "OK" {
+		return "OK"
+	}
+	reason, ok := jresp[1].(string)
+	if !ok {
+		return "Unknown Job"
+	}
+	return reason
+}
+
+// Validate a queue request and build the job it describes.  If the
+// request is no good, job is nil and reason explains why.
+//
+// This is shared by all of the audience interfaces.
+func (req *GenericJsonRequest) MakeJob() (job *o.JobRequest, reason string) {
+	if nil == req.Score {
+		o.Warn("Malformed Queue message talking to audience. Missing Score")
+		return nil, "Missing Score"
+	}
+	if nil == req.Scope {
+		o.Warn("Malformed Queue message talking to audience. Missing Scope")
+		return nil, "Missing Scope"
+	}
+	if nil == req.Players || len(req.Players) < 1 {
+		o.Warn("Malformed Queue message talking to audience. Missing Players")
+		return nil, "Missing Players"
+	}
+	// expand any groups and tags.
+	players, reason := ExpandPlayers(req.Players)
+	if nil == players {
+		return nil, reason
+	}
+	for _, player := range players {
+		if !HostAuthorised(player) {
+			o.Warn("Malformed Queue message - unknown player %s specified.", player)
+			return nil, "Invalid Player"
+		}
+	}
+	job = NewRequest()
+	job.Score = *req.Score
+	if !parseScope(*req.Scope, len(players), job) {
+		return nil, "Invalid Scope"
+	}
+	job.Players = players
+	job.Targets = make([]string, len(players))
+	copy(job.Targets, players)
+	job.Requested = req.Players
+	job.Params = req.Params
+	if nil != req.Batch {
+		if job.Scope != o.SCOPE_ALLOF {
+			return nil, "Batch Needs All Scope"
+		}
+		job.Batch = parseCount(*req.Batch, len(players))
+		if job.Batch < 1 {
+			return nil, "Invalid Batch"
+		}
+	}
+	if nil != req.Priority {
+		// keep the audience within bounds, so nobody can push
+		// everyone else out of the way indefinitely.
+		job.Priority = *req.Priority
+		if job.Priority > GetIntOpt("maximum priority") {
+			job.Priority = GetIntOpt("maximum priority")
+		}
+		if job.Priority < GetIntOpt("minimum priority") {
+			job.Priority = GetIntOpt("minimum priority")
+		}
+	}
+	if nil != req.Condition {
+		cond, ok := conditionFromName(*req.Condition)
+		if !ok {
+			return nil, "Invalid Condition"
+		}
+		job.Condition = cond
+	}
+	for _, id := range req.DependsOn {
+		if nil == o.JobGet(id) {
+			if JobExpired(id) {
+				return nil, "Expired Dependency"
+			}
+			return nil, "Unknown Dependency"
+		}
+	}
+	job.DependsOn = req.DependsOn
+	if nil != req.NotBefore {
+		if *req.NotBefore < 0 {
+			return nil, "Invalid NotBefore"
+		}
+		job.NotBefore = *req.NotBefore * 1e9
+	}
+	if nil != req.FailureBudget {
+		if nil == req.Batch {
+			return nil, "Failure Budget Needs Batch"
+		}
+		if *req.FailureBudget < 0 {
+			return nil, "Invalid Failure Budget"
+		}
+		job.FailureBudget = *req.FailureBudget
+	}
+	if nil != req.RunTimeout {
+		if *req.RunTimeout < 1 {
+			return nil, "Invalid Run Timeout"
+		}
+		job.Timeout = *req.RunTimeout
+	}
+
+	return job, ""
+}
+
+// Parse the audience's scope into the job.  As well as 'one' and 'all',
+// we understand:
+//
+//	any:N		- run on any N of the players.
+//	quorum:N	- run on all of the players, but N successes will do.
+//	quorum:P%	- as above, but P percent of the players.
+func parseScope(scope string, nplayers int, job *o.JobRequest) bool {
+	switch scope {
+	case "one":
+		job.Scope = o.SCOPE_ONEOF
+		return true
+	case "all":
+		job.Scope = o.SCOPE_ALLOF
+		return true
+	}
+	parts := strings.SplitN(scope, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	switch parts[0] {
+	case "any":
+		job.Scope = o.SCOPE_ANYOF
+	case "quorum":
+		job.Scope = o.SCOPE_QUORUM
 	default:
-		o.Warn("Unknown operation talking to audience: \"%s\"", *(outobj.Op))
+		return false
+	}
+	if job.Scope == o.SCOPE_ANYOF && strings.HasSuffix(parts[1], "%") {
+		return false
+	}
+	job.Quorum = parseCount(parts[1], nplayers)
+	if job.Quorum < 1 || job.Quorum > nplayers {
+		return false
+	}
+	return true
+}
+
+// Parse either a count, or a percentage of total (rounded up - 80% of
+// 9 players is 8 of them).  Returns -1 if it's no good.
+func parseCount(s string, total int) int {
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || pct < 1 || pct > 100 {
+			return -1
+		}
+		return (pct * total + 99) / 100
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// How the job's scope looks to the audience.
+func scopeName(job *o.JobRequest) string {
+	switch job.Scope {
+	case o.SCOPE_ANYOF:
+		fallthrough
+	case o.SCOPE_QUORUM:
+		return fmt.Sprintf("%s:%d", scopeNames[job.Scope], job.Quorum)
+	}
+	return scopeNames[job.Scope]
+}
+
+// Validate a list request and build the filter it describes.  If the
+// request is no good, filter is nil and reason explains why.
+func (req *GenericJsonRequest) MakeFilter() (filter *o.JobFilter, reason string) {
+	filter = new(o.JobFilter)
+	if nil != req.Score {
+		filter.Score = *req.Score
+	}
+	if nil != req.Player {
+		filter.Player = *req.Player
+	}
+	for _, name := range req.States {
+		state, ok := jobStateFromName(name)
+		if !ok {
+			return nil, "Invalid State"
+		}
+		filter.States = append(filter.States, state)
+	}
+	if nil != req.Since {
+		filter.CreatedAfter = *req.Since * 1e9
+	}
+	if nil != req.Until {
+		filter.CreatedBefore = *req.Until * 1e9
+	}
+	if nil != req.Cursor {
+		filter.Cursor = *req.Cursor
+	}
+	filter.Limit = DefaultListLimit
+	if nil != req.Limit {
+		if *req.Limit < 1 || *req.Limit > MaximumListLimit {
+			return nil, "Invalid Limit"
+		}
+		filter.Limit = *req.Limit
+	}
+
+	return filter, ""
+}
+
+// build the [error, list] response for a list request.
+func jobListResponse(filter *o.JobFilter) (jresp *[2]interface{}) {
+	jobs, more := o.JobList(filter)
+	lresp := new(JsonListResponse)
+	lresp.Jobs = make([]*JsonJobSummary, len(jobs))
+	for i, job := range jobs {
+		lresp.Jobs[i] = NewJsonJobSummary(job)
+	}
+	if more {
+		lresp.Next = new(uint64)
+		*lresp.Next = jobs[len(jobs)-1].Id
+	}
+	jresp = new([2]interface{})
+	jresp[0] = "OK"
+	jresp[1] = lresp
+
+	return jresp
+}
+
+// build the [error, status] response for a job.
+func jobStatusResponse(id uint64) (jresp *[2]interface{}) {
+	jresp = new([2]interface{})
+	job := o.JobGet(id)
+	if nil != job {
+		jresp[0] = "OK"
+		iresp := NewJsonStatusResponse()
+		iresp.Status = jobStateName(job.State)
+		iresp.Submitter = job.Submitter
+		iresp.Requested = job.Requested
+		iresp.Targets = job.Targets
+		iresp.DependsOn = job.DependsOn
+		resnames := o.JobGetResultNames(id)
+		for i := range resnames {
+			tr := o.JobGetResult(id, resnames[i])
+			if nil != tr {
+				iresp.Players[resnames[i]] = NewJsonPlayerStatusFromResult(tr)
+			}
+		}
+		jresp[1] = iresp
+	} else if JobExpired(id) {
+		jresp[0] = "Error"
+		jresp[1] = "Expired"
+	} else {
+		jresp[0] = "Error"
+		jresp[1] = nil
+	}
+	return jresp
+}
+
+// Block until the job reaches a final state, or timeout seconds have
+// passed.  A timeout of 0 waits forever.
+func waitForJob(id uint64, timeout int64) {
+	sub, rec := o.JobSubscribe(id)
+	if nil == sub {
+		return
+	}
+	defer o.JobUnsubscribe(sub)
+	if o.IsTerminalState(rec.State) {
+		return
+	}
+	var timer <-chan int64 = nil
+	if timeout > 0 {
+		timer = time.After(timeout * 1e9)
+	}
+	for {
+		select {
+		case ev := <-sub.Events:
+			if ev.Player == "" && o.IsTerminalState(ev.State) {
+				return
+			}
+		case <-timer:
+			return
+		}
+	}
+}
+
+// Stream changes to the job back to the audience, one object per
+// change, until the job reaches a final state.
+func watchJob(id uint64, enc *json.Encoder) {
+	sub, rec := o.JobSubscribe(id)
+	if nil == sub {
+		enc.Encode(jobStatusResponse(id))
 		return
 	}
+	defer o.JobUnsubscribe(sub)
+	sendIdSuccessResponse(id, enc)
+
+	// catch the audience up on what's already happened.
+	for player, tr := range rec.Results {
+		err := enc.Encode(NewJsonTaskEvent(id, player, tr))
+		if err != nil {
+			return
+		}
+	}
+	if o.IsTerminalState(rec.State) {
+		enc.Encode(NewJsonJobEvent(id, rec.State))
+		return
+	}
+	for ev := range sub.Events {
+		var err os.Error
+		if ev.Player == "" {
+			err = enc.Encode(NewJsonJobEvent(id, ev.State))
+			if o.IsTerminalState(ev.State) {
+				return
+			}
+		} else {
+			err = enc.Encode(NewJsonTaskEvent(id, ev.Player, ev.Result))
+		}
+		if err != nil {
+			o.Debug("Watcher for Job %d went away: %s", id, err)
+			return
+		}
+	}
+}
+
+func NewJsonJobEvent(id uint64, state int) (je *JsonJobEvent) {
+	je = new(JsonJobEvent)
+	je.Id = id
+	je.Status = jobStateName(state)
+
+	return je
+}
 
-	_ = enc
+func NewJsonTaskEvent(id uint64, player string, tr *o.TaskResponse) (je *JsonJobEvent) {
+	je = new(JsonJobEvent)
+	je.Id = id
+	je.Player = player
+	jps := NewJsonPlayerStatusFromResult(tr)
+	je.Status = jps.Status
+	je.Response = jps.Response
+
+	return je
 }
 
 func sendQueueSuccessResponse(job *o.JobRequest, enc *json.Encoder) {
+	sendIdSuccessResponse(job.Id, enc)
+}
+
+func sendIdSuccessResponse(id uint64, enc *json.Encoder) {
 	resp := make([]interface{},2)
 	resperr := new(string)
 	*resperr = "OK"
@@ -176,7 +807,7 @@ func sendQueueSuccessResponse(job *o.JobRequest, enc *json.Encoder) {
 
 	// this probably looks odd, but all numbers cross through float64 when being json encoded.  d'oh!
 	jobid := new(uint64)
-	*jobid = uint64(job.Id)
+	*jobid = id
 	resp[1] = jobid
 
 	err := enc.Encode(resp)
@@ -206,7 +837,67 @@ func AudienceListener(l net.Listener) {
 			o.Warn("Accept() failed on Audience Listenter.")
 			break
 		}
-		go handleAudienceRequest(c)
+		go handleUnixAudienceRequest(c)
+	}
+}
+
+// Local audience connections are identified by the credentials of the
+// connecting process.
+func handleUnixAudienceRequest(c net.Conn) {
+	who, err := peerIdentity(c)
+	if err != nil {
+		o.Warn("Couldn't get audience peer credentials: %s", err)
+	}
+	handleAudienceRequest(c, who)
+}
+
+// Remote audience connections must present a certificate signed by
+// one of our CAs.  The certificate's subject is recorded against any
+// jobs they queue.
+func handleTLSAudienceRequest(c net.Conn) {
+	tlsc, ok := c.(*tls.Conn)
+	if !ok {
+		o.Warn("Non-TLS connection on the remote audience listener")
+		c.Close()
+		return
+	}
+	err := tlsc.Handshake()
+	if err != nil {
+		o.Warn("TLS handshake with remote audience %s failed: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	cert, err := verifyPeerCertificate(tlsc, "")
+	if err != nil {
+		o.Warn("Couldn't verify remote audience %s: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	who := new(Identity)
+	who.Subject = subjectString(cert)
+	o.Debug("Remote audience connection from %s (%s)", c.RemoteAddr(), who)
+	handleAudienceRequest(c, who)
+}
+
+func TLSAudienceListener(laddr string) {
+	var sockConfig tls.Config
+
+	sockConfig.Certificates = append(sockConfig.Certificates, ServerCert)
+	sockConfig.RootCAs = CACertPool
+	// we want the client's certificate, and we'll check it ourselves.
+	sockConfig.AuthenticateClient = true
+
+	l, err := tls.Listen("tcp", laddr, &sockConfig)
+	o.MightFail(err, "Couldn't start remote audience listener")
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			o.Warn("Accept() failed on Remote Audience Listener.")
+			break
+		}
+		go handleTLSAudienceRequest(c)
 	}
 }
 
@@ -241,4 +932,10 @@ func UnixAudienceListener(sockaddr string) {
 func StartAudienceSock() {
 	audienceSockPath := strings.TrimSpace(GetStringOpt("audience socket path"))
 	go UnixAudienceListener(audienceSockPath)
+
+	if GetBoolOpt("remote audience") {
+		bindAddr := GetStringOpt("bind address")
+		laddr := fmt.Sprintf("%s:%d", bindAddr, o.DefaultAudiencePort)
+		go TLSAudienceListener(laddr)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,227 @@
+/* audit.go
+ *
+ * Audit log.
+ *
+ * Every audience request, and every change in the state of a job, is
+ * appended to the audit log under the conductor state path as a line of
+ * JSON.  The log is rotated once it grows past a configured size.
+*/
+
+package main
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"path"
+	"strings"
+	"time"
+	o "orchestra"
+)
+
+const (
+	auditQueueDepth	= 100
+	redactedValue	= "REDACTED"
+)
+
+type AuditRecord struct {
+	// seconds since the epoch.
+	Time		int64
+	// "request" for audience requests, "job" for a change in a job's
+	// aggregate state, and "task" for a result from a player.
+	Event		string
+	Submitter	string
+	// where the request came from.
+	Peer		string
+	Op		string
+	Id		uint64
+	Score		string
+	Scope		string
+	Players		[]string
+	Params		map[string]string
+	Player		string
+	// "OK" or the error reason for requests, the new status for job
+	// and task events.
+	Result		string
+}
+
+var auditQ = make(chan *AuditRecord, auditQueueDepth)
+
+func auditLogPath() string {
+	return path.Join(GetStringOpt("conductor state path"), "audit.log")
+}
+
+// copy the parameters, hiding the values of any that match the
+// redaction patterns.  Parameter names aren't case sensitive here, so
+// that *password* catches Password as well.
+func redactParams(params map[string]string) (redacted map[string]string) {
+	if len(params) == 0 {
+		return nil
+	}
+	patterns := splitPatterns(strings.ToLower(GetStringOpt("audit redact params")))
+	redacted = make(map[string]string)
+	for k, v := range params {
+		if matchAny(patterns, strings.ToLower(k)) {
+			redacted[k] = redactedValue
+		} else {
+			redacted[k] = v
+		}
+	}
+	return redacted
+}
+
+// Record an audience request.  op is the operation requested, req is
+// the request (which may be nil if it couldn't be decoded), id is the
+// job concerned (if any) and result is "OK" or the reason the request
+// failed.
+func AuditRequest(who *Identity, peer string, op string, req *GenericJsonRequest, id uint64, result string) {
+	if !GetBoolOpt("audit log") {
+		return
+	}
+	rec := new(AuditRecord)
+	rec.Time = time.Seconds()
+	rec.Event = "request"
+	rec.Submitter = who.String()
+	rec.Peer = peer
+	rec.Op = op
+	rec.Id = id
+	if nil != req {
+		if nil != req.Score {
+			rec.Score = *req.Score
+		}
+		if nil != req.Scope {
+			rec.Scope = *req.Scope
+		}
+		rec.Players = req.Players
+		rec.Params = redactParams(req.Params)
+		if rec.Id == 0 && nil != req.Id {
+			rec.Id = *req.Id
+		}
+	}
+	rec.Result = result
+
+	auditQ <- rec
+}
+
+func newAuditJobRecord(ev *o.JobEvent) (rec *AuditRecord) {
+	rec = new(AuditRecord)
+	rec.Time = time.Seconds()
+	rec.Id = ev.Id
+	if ev.Player == "" {
+		rec.Event = "job"
+		rec.Result = jobStateName(ev.State)
+	} else {
+		rec.Event = "task"
+		rec.Player = ev.Player
+		rec.Result = taskStateName(ev.State)
+	}
+	job := o.JobGet(ev.Id)
+	if nil != job {
+		rec.Submitter = job.Submitter
+		rec.Score = job.Score
+		rec.Scope = scopeName(job)
+		if ev.Player == "" {
+			rec.Players = job.Players
+			rec.Params = redactParams(job.Params)
+		}
+	}
+	return rec
+}
+
+type auditLog struct {
+	fh	*os.File
+	size	int64
+}
+
+func (al *auditLog) open() {
+	err := os.MkdirAll(GetStringOpt("conductor state path"), 0700)
+	if err != nil {
+		o.Warn("Couldn't create conductor state directory: %s", err)
+		return
+	}
+	fname := auditLogPath()
+	fh, err := os.OpenFile(fname, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		o.Warn("Couldn't open audit log %s: %s", fname, err)
+		return
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		o.Warn("Couldn't stat audit log %s: %s", fname, err)
+		fh.Close()
+		return
+	}
+	al.fh = fh
+	al.size = fi.Size
+}
+
+// shuffle audit.log.N-1 to audit.log.N and so on, then start a new
+// log.
+func (al *auditLog) rotate() {
+	if al.fh != nil {
+		al.fh.Close()
+		al.fh = nil
+	}
+	fname := auditLogPath()
+	keep := GetIntOpt("audit log rotations")
+	if keep > 0 {
+		for i := keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", fname, i), fmt.Sprintf("%s.%d", fname, i+1))
+		}
+		err := os.Rename(fname, fname+".1")
+		if err != nil {
+			o.Warn("Couldn't rotate audit log: %s", err)
+		}
+	} else {
+		os.Remove(fname)
+	}
+	al.open()
+}
+
+func (al *auditLog) write(rec *AuditRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		o.Warn("Couldn't encode audit record: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if al.fh == nil {
+		al.open()
+	}
+	maxSize := int64(GetIntOpt("audit log size"))
+	if al.fh != nil && maxSize > 0 && al.size > 0 && al.size + int64(len(data)) > maxSize {
+		al.rotate()
+	}
+	if al.fh == nil {
+		return
+	}
+	n, err := al.fh.Write(data)
+	al.size += int64(n)
+	if err != nil {
+		o.Warn("Couldn't write audit record: %s", err)
+		// try again with a fresh file next time.
+		al.fh.Close()
+		al.fh = nil
+	}
+}
+
+func auditLoop(sub *o.JobSubscription) {
+	al := new(auditLog)
+	for {
+		select {
+		case rec := <-auditQ:
+			al.write(rec)
+		case ev := <-sub.Events:
+			if GetBoolOpt("audit log") {
+				al.write(newAuditJobRecord(ev))
+			}
+		}
+	}
+}
+
+func StartAudit() {
+	// the registry will tell us about every job that changes state.
+	sub, _ := o.JobSubscribe(0)
+	go auditLoop(sub)
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 	"os"
 	"crypto/tls"
-	"crypto/x509"
 )
 
 const (
@@ -26,6 +25,7 @@ type ClientInfo struct {
 	PktInQ		chan *o.WirePkt
 	abortQ		chan int
 	TaskQ		chan *o.TaskRequest
+	cancelQ		chan uint64
 	connection	net.Conn
 	pendingTasks	map[uint64]*o.TaskRequest
 }
@@ -36,6 +36,7 @@ func NewClientInfo() (client *ClientInfo) {
 	client.PktOutQ = make(chan *o.WirePkt, OutputQueueDepth)
 	client.PktInQ = make(chan *o.WirePkt)
 	client.TaskQ = make(chan *o.TaskRequest)
+	client.cancelQ = make(chan uint64, OutputQueueDepth)
 
 	return client
 }
@@ -45,6 +46,7 @@ func (client *ClientInfo) Abort() {
 	reg := ClientGet(client.Player)
 	if reg != nil {
 		reg.Disassociate()
+		ClientSetConnected(client.Player, false)
 	}
 	client.abortQ <- 1;
 }
@@ -71,15 +73,38 @@ func (client *ClientInfo) sendNow(p *o.WirePkt) {
 }
 
 func (client *ClientInfo) SendTask(task *o.TaskRequest) {
-	tr := task.Encode()
-	p, err := o.Encode(tr)
-	o.MightFail(err, "Couldn't encode task for client.")
+	var p *o.WirePkt
+	if task.Job.Cancelled {
+		// keep telling the player to stop until it reports back.
+		p = o.MakeCancelTask(task.Job.Id)
+	} else {
+		tr := task.Encode()
+		var err os.Error
+		p, err = o.Encode(tr)
+		o.MightFail(err, "Couldn't encode task for client.")
+	}
 	client.Send(p)
 	task.RetryTime = time.Nanoseconds() + RetryDelay
 }
 
+// Ask the player to stop working on a job.  Safe to call from outside
+// of the client's handlers.  If the client isn't connected, or is too
+// busy, the retry loop will send the cancellation instead.
+func (client *ClientInfo) CancelTask(id uint64) {
+	select {
+	case client.cancelQ <- id:
+	default:
+	}
+}
+
 func (client *ClientInfo) GotTask(task *o.TaskRequest) {
 	/* first up, look at the task state */
+	if task.Job.Cancelled && task.State == o.TASK_QUEUED {
+		/* cancelled whilst on its way to us.  Never mind. */
+		task.State = o.TASK_FINISHED
+		o.JobReviewState(task.Job.Id)
+		SaveJob(task.Job.Id)
+	}
 	switch (task.State) {
 	case o.TASK_QUEUED:
 		fallthrough
@@ -88,16 +113,26 @@ func (client *ClientInfo) GotTask(task *o.TaskRequest) {
 		task.Player = client.Player
 		task.State = o.TASK_PENDINGRESULT
 		client.pendingTasks[task.Job.Id] = task
+		ClientSetPending(client.Player, len(client.pendingTasks))
+		SaveJob(task.Job.Id)
 		client.SendTask(task)
 	case o.TASK_FINISHED:
-		/* discard.  We don't care about tasks that are done. */		
+		/* discard.  We don't care about tasks that are done.
+		 *
+		 * The player is still waiting for work though, so put it
+		 * back in the idle queue. */
+		PlayerWaitingForJob(client)
 	}
+	/* the task is ours now (or nobody's), so the dispatcher's claim
+	 * isn't needed any more. */
+	task.ClaimedBy = ""
 }
 
 // reset the task state so it can be requeued.
 func CleanTask(task *o.TaskRequest) {
 	task.State = o.TASK_QUEUED
 	task.Player = ""
+	task.ClaimedBy = ""
 }
 
 // this merges the state from the registry record into the client it's called against.
@@ -107,6 +142,7 @@ func (client *ClientInfo) MergeState(regrecord *ClientInfo) {
 	client.pendingTasks = regrecord.pendingTasks
 
 	regrecord.TaskQ = client.TaskQ
+	regrecord.cancelQ = client.cancelQ
 	regrecord.abortQ = client.abortQ
 	regrecord.PktOutQ = client.PktOutQ
 	regrecord.PktInQ = client.PktInQ
@@ -116,6 +152,7 @@ func (client *ClientInfo) MergeState(regrecord *ClientInfo) {
 // Sever the connection state from the client (used against registry records only)
 func (client *ClientInfo) Disassociate() {
 	client.TaskQ = nil
+	client.cancelQ = nil
 	client.abortQ = nil
 	client.PktInQ = nil
 	client.PktOutQ = nil
@@ -144,34 +181,8 @@ func handleIdentify(client *ClientInfo, message interface{}) {
 	/* if we're TLS, verify the client's certificate given the name it used */
 	tlsc, ok := client.connection.(*tls.Conn)
 	if ok {
-		intermediates := x509.NewCertPool()
-
 		o.Debug("Connection is TLS.")
-		o.Debug("Checking Connection State")
-		cs := tlsc.ConnectionState()
-		vo := x509.VerifyOptions{
-		Roots: CACertPool,
-		Intermediates: intermediates,
-		DNSName: client.Player,
-		}
-		if cs.PeerCertificates == nil || cs.PeerCertificates[0] == nil {
-			o.Warn("Peer didn't provide a certificate. Aborting Connection.")
-			client.Abort()
-			return
-		}
-		// load any intermediate certificates from the chain
-		// into the intermediates pool so we can verify that
-		// the chain can be rebuilt.
-		//
-		// All we care is that we can reach an authorised CA.
-		//
-		//FIXME: Need CRL handling.
-		if len(cs.PeerCertificates) > 1 {
-			for i := 1; i < len(cs.PeerCertificates); i++ {
-				intermediates.AddCert(cs.PeerCertificates[i])
-			}
-		}
-		_, err := cs.PeerCertificates[0].Verify(vo)
+		_, err := verifyPeerCertificate(tlsc, client.Player)
 		if err != nil {
 			o.Warn("couldn't verify client certificate: %s", err)
 			client.Abort()
@@ -185,6 +196,8 @@ func handleIdentify(client *ClientInfo, message interface{}) {
 		return
 	}
 	client.MergeState(reg)
+	ClientSetConnected(client.Player, true)
+	ClientSetPending(client.Player, len(client.pendingTasks))
 }
 
 func handleReadyForTask(client *ClientInfo, message interface{}) {
@@ -210,18 +223,18 @@ func handleResult(client *ClientInfo, message interface{}){
 			nack := o.MakeNack(r.Id)
 			client.sendNow(nack)
 		} else {
-			job := o.JobGet(r.Id)
-			if job != nil {
-				o.Debug("Got Response.  Acking.")
-				/* if the job exists, Ack it. */
-				ack := o.MakeAck(r.Id)
-				client.sendNow(ack)
-			}
 			// now, we only accept the results if we were
 			// expecting the results (ie: it was pending)
 			// and expunge the task information from the
 			// pending list so we stop bugging the client for it.
 			task, exists := client.pendingTasks[r.Id]
+			if !exists {
+				// a job restored from disk won't be in our
+				// pending list until it's been redispatched,
+				// but the task will still remember who had it.
+				task = findPendingTask(job, client.Player)
+				exists = task != nil
+			}
 			if exists {
 				// store the result.
 				o.JobAddResult(client.Player, r)
@@ -233,10 +246,10 @@ func handleResult(client *ClientInfo, message interface{}){
 					o.Info("Client %s reports failure for Job %d", client.Name(), r.Id)
 					if r.CanRetry() {
 						job := o.JobGet(r.Id)
-						if job.Scope == o.SCOPE_ONEOF {
+						if job.IsFloating() && !job.Cancelled && !job.IsTerminal() {
 							// right, we're finally deep enough to work out what's going on!
 							o.JobDisqualifyPlayer(r.Id, client.Player)
-							if len(job.Players) >= 1 {
+							if job.HasSpareTarget(task) {
 								// still players left we can try?  then go for it!
 								CleanTask(task)
 								DispatchTask(task)
@@ -251,14 +264,45 @@ func handleResult(client *ClientInfo, message interface{}){
 				}
 				// update the job state.
 				o.JobReviewState(r.Id)
+				// and see if a rolling job can move on.
+				AdvanceRollout(r.Id)
+				if job.IsTerminal() && !job.Cancelled {
+					// a quorum job can finish early - don't
+					// bother running the rest of it.
+					n := WithdrawJob(r.Id)
+					if n > 0 {
+						o.Info("Job %d: Finished early. Withdrew %d queued tasks", r.Id, n)
+					}
+					n = cancelRunningTasks(job)
+					if n > 0 {
+						o.Info("Job %d: Finished early. Cancelling %d running tasks", r.Id, n)
+					}
+				}
+				SaveJob(r.Id)
 
 				client.pendingTasks[r.Id] = nil, false
+				ClientSetPending(client.Player, len(client.pendingTasks))
 			}
+			// only Ack once the result is safely stored.
+			o.Debug("Got Response.  Acking.")
+			ack := o.MakeAck(r.Id)
+			client.sendNow(ack)
 		}
 	}
 }
 
 
+// find the task for a job that the player was working on when we last
+// knew about it.
+func findPendingTask(job *o.JobRequest, player string) *o.TaskRequest {
+	for _, task := range job.Tasks {
+		if task.Player == player && task.State == o.TASK_PENDINGRESULT {
+			return task
+		}
+	}
+	return nil
+}
+
 var dispatcher	= map[uint8] func(*ClientInfo,interface{}) {
 	o.TypeNop:		handleNop,
 	o.TypeIdentifyClient:	handleIdentify,
@@ -342,6 +386,11 @@ func clientLogic(client *ClientInfo) {
 			}
 		case t := <-client.TaskQ:
 			client.GotTask(t)
+		case id := <-client.cancelQ:
+			task, exists := client.pendingTasks[id]
+			if exists {
+				client.SendTask(task)
+			}
 		case <-client.abortQ:
 			o.Debug("Client %s connection has been told to abort!", client.Name())
 			loop = false
@@ -24,11 +24,19 @@ func main() {
 	StartRegistry()
 	// do an initial configuration load
 	ConfigLoad()
+	// load our certificates and CAs before anything starts listening.
+	LoadCertificates()
+
+	// start recording job changes before anything can change.
+	StartAudit()
 
 	// start the master dispatch system
 	InitDispatch()
 	defer CleanDispatch()
 
+	// start evicting old jobs
+	StartJobExpiry()
+
 	// start the status listener
 	StartHTTP()
 	// start the audience listener
@@ -19,6 +19,19 @@ func init() {
 	configFile.Add("audience socket path", configureit.NewStringOption("/var/run/conductor.sock"))
 	configFile.Add("conductor state path", configureit.NewStringOption("/var/spool/orchestra"))
 	configFile.Add("player file path", configureit.NewStringOption("/etc/orchestra/players"))
+	configFile.Add("audience policy path", configureit.NewStringOption(""))
+	configFile.Add("workflow path", configureit.NewStringOption(""))
+	configFile.Add("http audience api", configureit.NewStringOption("no"))
+	configFile.Add("remote audience", configureit.NewStringOption("no"))
+	configFile.Add("audit log", configureit.NewStringOption("yes"))
+	configFile.Add("audit log size", configureit.NewIntOption(10485760))
+	configFile.Add("audit log rotations", configureit.NewIntOption(5))
+	configFile.Add("audit redact params", configureit.NewStringOption("*password* *secret* *token*"))
+	configFile.Add("priority aging interval", configureit.NewIntOption(60))
+	configFile.Add("minimum priority", configureit.NewIntOption(-10))
+	configFile.Add("maximum priority", configureit.NewIntOption(10))
+	configFile.Add("job retention age", configureit.NewIntOption(604800))
+	configFile.Add("job retention count", configureit.NewIntOption(10000))
 }
 
 func GetStringOpt(key string) string {
@@ -33,6 +46,33 @@ func GetStringOpt(key string) string {
 	return strings.TrimSpace(sopt.Value)
 }
 
+// boolean options are strings that we interpret ourselves.
+func GetBoolOpt(key string) bool {
+	switch strings.ToLower(GetStringOpt(key)) {
+	case "yes":
+		fallthrough
+	case "true":
+		fallthrough
+	case "on":
+		fallthrough
+	case "1":
+		return true
+	}
+	return false
+}
+
+func GetIntOpt(key string) int {
+	cnode := configFile.Get(key)
+	if cnode == nil {
+		o.Assert("tried to get a configuration option that doesn't exist.")
+	}
+	iopt, ok := cnode.(*configureit.IntOption)
+	if !ok {
+		o.Assert("tried to get a non-int configuration option with GetIntOpt")
+	}
+	return iopt.Value
+}
+
 
 func GetCACertList() []string {
 	cnode := configFile.Get("ca certificates")
@@ -62,7 +102,7 @@ func ConfigLoad() {
 
 	pbr := bufio.NewReader(pfh)
 
-	ahmap := make(map[string]bool)
+	pd := NewPlayerDirectory()
 	for err = nil; err == nil; {
 		var lb		[]byte
 		var prefix	bool
@@ -83,16 +123,30 @@ func ConfigLoad() {
 		if line[0] == '#' {
 			continue;
 		}
-		ahmap[line] = true
+		if !pd.AddLine(line) {
+			o.Warn("ConfigLoad: Ignoring malformed line in \"%s\": %s", playerpath, line)
+		}
+	}
+	SetPlayerDirectory(pd)
+	ClientUpdateKnown(pd.Players())
+
+	policypath := GetStringOpt("audience policy path")
+	if policypath != "" {
+		policy, err := LoadPolicy(policypath)
+		o.MightFail(err, "Couldn't load audience policy")
+		SetPolicy(policy)
+	} else {
+		SetPolicy(nil)
 	}
-	// convert newAuthorisedHosts to a slice
-	authorisedHosts := make([]string, len(ahmap))
-	idx := 0
-	for k,_ := range ahmap {
-		authorisedHosts[idx] = k
-		idx++
+
+	workflowpath := GetStringOpt("workflow path")
+	if workflowpath != "" {
+		wfs, err := LoadWorkflows(workflowpath)
+		o.MightFail(err, "Couldn't load workflows")
+		SetWorkflows(wfs)
+	} else {
+		SetWorkflows(make(map[string]*Workflow))
 	}
-	ClientUpdateKnown(authorisedHosts)
 }
 
 
@@ -0,0 +1,171 @@
+/* cron.go
+ *
+ * Cron style schedule parsing.
+ *
+ * We understand the usual five fields - minute, hour, day of month,
+ * month and day of week - each of which may be '*', a number, a range
+ * ('a-b'), a step ('*' or a range followed by '/n'), or a comma
+ * separated list of those.  As with cron, if both the day of month and
+ * the day of week are restricted, a day matching either will do.
+*/
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CronSpec struct {
+	minute		[]bool
+	hour		[]bool
+	dom		[]bool
+	month		[]bool
+	dow		[]bool
+	// true if the field was '*'.
+	domStar		bool
+	dowStar		bool
+}
+
+// the furthest ahead (in hours) we'll look for a match.  Long enough
+// to find Feb 29th, even across 2100.
+const cronSearchLimit = 8 * 366 * 24
+
+// the longest each month can be.
+var cronMonthDays = []int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+func parseCronNumber(s string, min, max int) (n int, err os.Error) {
+	n, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, os.NewError("\"" + s + "\" out of range")
+	}
+	return n, nil
+}
+
+func parseCronField(field string, min, max int) (set []bool, star bool, err os.Error) {
+	set = make([]bool, max+1)
+	star = field == "*"
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		parts := strings.SplitN(item, "/", 2)
+		if len(parts) == 2 {
+			step, err = strconv.Atoi(parts[1])
+			if err != nil || step < 1 {
+				return nil, false, os.NewError("bad step in \"" + item + "\"")
+			}
+		}
+		lo, hi := min, max
+		if parts[0] != "*" {
+			bounds := strings.SplitN(parts[0], "-", 2)
+			lo, err = parseCronNumber(bounds[0], min, max)
+			if err != nil {
+				return nil, false, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = parseCronNumber(bounds[1], min, max)
+				if err != nil {
+					return nil, false, err
+				}
+			} else if len(parts) == 2 {
+				// 'a/n' means from a to the end.
+				hi = max
+			}
+			if hi < lo {
+				return nil, false, os.NewError("backwards range \"" + item + "\"")
+			}
+		}
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+	return set, star, nil
+}
+
+func ParseCron(spec string) (cs *CronSpec, err os.Error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, os.NewError("expected 5 fields")
+	}
+	cs = new(CronSpec)
+	if cs.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, cs.domStar, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7.
+	if cs.dow, cs.dowStar, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	if !cs.possible() {
+		return nil, os.NewError("no month has those days")
+	}
+	return cs, nil
+}
+
+// false if the days of the month can never happen in the months
+// given, like the 31st of February.  If the day of the week is
+// restricted too, any of those days will do, so that's always possible.
+func (cs *CronSpec) possible() bool {
+	if cs.domStar || !cs.dowStar {
+		return true
+	}
+	for month := 1; month <= 12; month++ {
+		if !cs.month[month] {
+			continue
+		}
+		for day := 1; day <= cronMonthDays[month]; day++ {
+			if cs.dom[day] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cs *CronSpec) dayMatches(t *time.Time) bool {
+	if !cs.month[t.Month] {
+		return false
+	}
+	domOk := cs.dom[t.Day]
+	dowOk := cs.dow[t.Weekday]
+	if cs.domStar || cs.dowStar {
+		return domOk && dowOk
+	}
+	return domOk || dowOk
+}
+
+// Find the first matching minute after t (seconds since the epoch, in
+// local time).  Returns 0 if there isn't one.  We go an hour at a
+// time, and only look at the minutes of the hours that match.
+func (cs *CronSpec) Next(t int64) int64 {
+	t = t - (t % 60) + 60
+	for i := 0; i < cronSearchLimit; i++ {
+		tm := time.SecondsToLocalTime(t)
+		if cs.hour[tm.Hour] && cs.dayMatches(tm) {
+			for m := tm.Minute; m < 60; m++ {
+				if cs.minute[m] {
+					return t + int64(m-tm.Minute)*60
+				}
+			}
+		}
+		// on to the start of the next hour.
+		t += int64(60-tm.Minute) * 60
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+/* depend.go
+ *
+ * Job dependencies.
+ *
+ * A job that depends on others is registered with all of its tasks
+ * held.  Whenever a job finishes, we look at the jobs waiting on it and
+ * either release them, or fail them if their condition can no longer
+ * be met.
+*/
+
+package main
+
+import (
+	"sync"
+	o "orchestra"
+)
+
+var (
+	// the jobs waiting on each job.
+	dependents	= make(map[uint64][]uint64)
+	dependLock	sync.Mutex
+)
+
+var conditionNames = map[int]string {
+	o.DEPEND_ON_SUCCESS:	"success",
+	o.DEPEND_ON_FAILURE:	"failure",
+	o.DEPEND_ALWAYS:	"always",
+}
+
+func conditionFromName(name string) (cond int, ok bool) {
+	for k, v := range conditionNames {
+		if v == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// Remember which jobs this job is waiting for.
+func RegisterDependencies(job *o.JobRequest) {
+	dependLock.Lock()
+	defer dependLock.Unlock()
+
+	for _, id := range job.DependsOn {
+		dependents[id] = append(dependents[id], job.Id)
+	}
+}
+
+// Work out whether the job can start.  ready is true once the outcome
+// is known, and failed is true if the condition can't be met.
+func dependencyState(job *o.JobRequest) (ready bool, failed bool) {
+	finished := 0
+	succeeded := 0
+	for _, id := range job.DependsOn {
+		dep := o.JobGet(id)
+		if nil == dep {
+			// expired, so we'll never know how it went.
+			o.Warn("Job %d: Dependency %d has gone away", job.Id, id)
+			return true, true
+		}
+		if !dep.IsTerminal() {
+			continue
+		}
+		finished++
+		if dep.State == o.JOB_SUCCESSFUL {
+			succeeded++
+		} else if job.Condition == o.DEPEND_ON_SUCCESS {
+			// no point waiting for the rest.
+			return true, true
+		}
+	}
+	if finished < len(job.DependsOn) {
+		return false, false
+	}
+	switch job.Condition {
+	case o.DEPEND_ON_FAILURE:
+		return true, succeeded == finished
+	}
+	return true, false
+}
+
+// Fail a job whose dependencies can't be met.
+func failDependency(job *o.JobRequest) {
+	rolloutLock.Lock()
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_HELD {
+			task.State = o.TASK_FINISHED
+		}
+	}
+	rolloutLock.Unlock()
+
+	o.Info("Job %d: Dependencies can't be satisfied", job.Id)
+	o.JobFailDependency(job.Id)
+	SaveJob(job.Id)
+}
+
+// release (or fail) anything waiting on the job.
+func jobFinished(id uint64) {
+	dependLock.Lock()
+	waiting := dependents[id]
+	dependents[id] = nil, false
+	dependLock.Unlock()
+
+	for _, depId := range waiting {
+		releaseJob(depId)
+	}
+}
+
+func dependLoop(sub *o.JobSubscription) {
+	for ev := range sub.Events {
+		if ev.Player == "" && o.IsTerminalState(ev.State) {
+			jobFinished(ev.Id)
+		}
+	}
+}
+
+func StartDependencies() {
+	sub, _ := o.JobSubscribe(0)
+	go dependLoop(sub)
+}
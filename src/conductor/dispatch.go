@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"fmt"
 	"strings"
+	"time"
 	o "orchestra"
 )
 
@@ -32,6 +33,7 @@ func savePath() string {
 }
 
 func loadLastId() {
+	loadSkippedIds()
 	fh, err := os.Open(checkpointPath())
 	if err == nil {
 		defer fh.Close()
@@ -43,6 +45,7 @@ func loadLastId() {
 		if err != nil {
 			o.Fail("Couldn't read Last ID from checkpoint file.  Aborting for safety.")
 		}
+		recordSkippedIds(lastId+1, lastId+IdCheckpointSafetySkip)
 		lastId += IdCheckpointSafetySkip
 	} else {
 		pe, ok := err.(*os.PathError)	
@@ -107,6 +110,7 @@ var rqTask		= make(chan *o.TaskRequest, messageBuffer)
 var playerIdle		= make(chan *ClientInfo, messageBuffer)
 var playerDead		= make(chan *ClientInfo, messageBuffer)
 var statusRequest	= make(chan(chan *QueueInformation))
+var withdrawRequest	= make(chan *withdrawInfo)
 
 func PlayerWaitingForJob(player *ClientInfo) {
 	playerIdle <- player
@@ -120,18 +124,56 @@ func DispatchTask(task *o.TaskRequest) {
 	rqTask <- task
 }
 
+type withdrawInfo struct {
+	id		uint64
+	responseChannel	chan int
+}
+
+// Remove all of a job's tasks from the waiting task queue.  Returns
+// the number of tasks that were withdrawn.
+func WithdrawJob(id uint64) int {
+	wi := new(withdrawInfo)
+	wi.id = id
+	wi.responseChannel = make(chan int, 1)
+
+	withdrawRequest <- wi
+	return <- wi.responseChannel
+}
+
 type QueueInformation struct {
 	idlePlayers 	[]string
 	waitingTasks	int
+	depths		map[int]int
 }
 
-func DispatchStatus() (waitingTasks int, waitingPlayers []string) {
+// Get the number of waiting tasks, the idle players, and the number of
+// waiting tasks at each priority.  A player appears in the idle list
+// once for each of its free slots.
+func DispatchStatus() (waitingTasks int, waitingPlayers []string, depths map[int]int) {
 	r := make(chan *QueueInformation)
 
 	statusRequest <- r
 	s := <- r
 
-	return s.waitingTasks, s.idlePlayers
+	return s.waitingTasks, s.idlePlayers, s.depths
+}
+
+// a task waiting in the dispatch queue.
+type queuedTask struct {
+	task	*o.TaskRequest
+	// when it was queued, for aging.
+	since	int64
+}
+
+// The priority the task has after it's been waiting a while.  Tasks
+// gain a level for every aging interval (in ns) they wait, so nothing
+// gets starved forever.
+func (qt *queuedTask) effectivePriority(now, interval int64) int {
+	prio := qt.task.Job.Priority
+	if interval > 0 {
+		prio += int((now - qt.since) / interval)
+	}
+	return prio
 }
 
 func InitDispatch() {
@@ -139,6 +181,22 @@ func InitDispatch() {
 	loadLastId()
 
 	go masterDispatch(); // go!
+
+	// start watching for dependencies being met.
+	StartDependencies()
+
+	// replay the saved jobs, and requeue anything that was still
+	// outstanding when we went away.
+	tasks := LoadJobs()
+	for _, task := range tasks {
+		DispatchTask(task)
+	}
+
+	// and pick up the delayed and recurring jobs.
+	StartScheduler()
+
+	// and carry on with any workflow runs.
+	StartWorkflows()
 }
 
 func CleanDispatch() {
@@ -150,74 +208,232 @@ func QueueJob(job *o.JobRequest) {
 	job.Id = nextRequestId()
 	/* first up, split the job up into it's tasks. */
 	job.Tasks = job.MakeTasks()
+	if job.NotBefore > time.Nanoseconds() || len(job.DependsOn) > 0 {
+		/* delayed and dependent jobs are held until they're due */
+		for _, task := range job.Tasks {
+			task.State = o.TASK_HELD
+		}
+	} else {
+		/* rolling jobs only get their first batch to start with */
+		HoldTasks(job)
+	}
 	/* add it to the registry */
 	o.JobAdd(job)
+	/* and get it on disk before anybody is told about it */
+	SaveJob(job.Id)
 	/* an enqueue all of the tasks */
 	for i := range job.Tasks {
-		DispatchTask(job.Tasks[i])
+		if job.Tasks[i].State == o.TASK_QUEUED {
+			DispatchTask(job.Tasks[i])
+		}
+	}
+	if jobAwaitingRelease(job) {
+		/* the dependencies might have finished already, so the
+		 * scheduler will check them once it's due. */
+		RegisterDependencies(job)
+		DelayJob(job.Id, job.NotBefore)
+	}
+}
+
+// Cancel a job.  Tasks that haven't been sent to a player yet are
+// discarded, and players running the job are told to kill it.  The job
+// finishes once the players have reported back.
+func CancelJob(id uint64) (ok bool, reason string) {
+	job := o.JobGet(id)
+	if nil == job {
+		if JobExpired(id) {
+			return false, "Expired"
+		}
+		return false, "Unknown Job"
 	}
+	if !o.JobCancel(id) {
+		return false, "Job Already Finished"
+	}
+	o.Info("Job %d: Cancelling", id)
+	n := WithdrawJob(id)
+	n += DropHeldTasks(job)
+	o.Debug("Job %d: Withdrew %d queued tasks", id, n)
+	cancelRunningTasks(job)
+	o.JobReviewState(id)
+	SaveJob(id)
+
+	return true, ""
+}
+
+// Tell the players working on the job's tasks to kill them.  Returns
+// how many were told.
+func cancelRunningTasks(job *o.JobRequest) (n int) {
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_PENDINGRESULT && task.Player != "" {
+			client := ClientGet(task.Player)
+			if client != nil {
+				client.CancelTask(job.Id)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// a task that's been given to a player, but which the player's client
+// hasn't picked up yet.
+type handoff struct {
+	player	*ClientInfo
+	qt	*queuedTask
 }
 
 func masterDispatch() {
 	pq := list.New()
 	tq := list.New()
+	// tasks are handed over one at a time as the clients get round to
+	// taking them, so we never wait on a client that might be waiting
+	// on us.
+	handoffs := list.New()
+
+	/* claim the task for the player, so no other task from the same
+	 * job goes to it before its client has picked this one up. */
+	handOver := func(player *ClientInfo, qt *queuedTask) {
+		qt.task.ClaimedBy = player.Player
+		handoffs.PushBack(&handoff{player, qt})
+	}
+	/* find the most important thing we have for this player, or put
+	 * it in the waiting players queue if there isn't anything. */
+	playerReady := func(player *ClientInfo) {
+		/* Ties go to whatever has been waiting longest. */
+		now := time.Nanoseconds()
+		interval := int64(GetIntOpt("priority aging interval")) * 1e9
+		var best *list.Element = nil
+		bestPrio := 0
+		for i := tq.Front(); i != nil; i = i.Next() {
+			qt,_ := i.Value.(*queuedTask)
+			if !qt.task.IsTarget(player.Player) {
+				continue
+			}
+			prio := qt.effectivePriority(now, interval)
+			if nil == best || prio > bestPrio {
+				best = i
+				bestPrio = prio
+			}
+		}
+		if (nil == best) {
+			/* Out of items! */
+			/* Append this player to the waiting players queue */
+			pq.PushBack(player)
+		} else {
+			/* Found a valid job. Send it to the player, and remove it from our pending 
+			 * list */
+			qt,_ := best.Value.(*queuedTask)
+			tq.Remove(best)
+			handOver(player, qt)
+		}
+	}
+	/* find a waiting player for the task, or put it in the waiting
+	 * tasks queue if there isn't one. */
+	taskReady := func(qt *queuedTask) {
+		for i := pq.Front(); i != nil; i = i.Next() {
+			p,_ := i.Value.(*ClientInfo)
+			if qt.task.IsTarget(p.Player) {
+				/* Found it. */
+				pq.Remove(i)
+				handOver(p, qt)
+				return
+			}
+		}
+		/* Out of players! */
+		/* Append this task to the waiting tasks queue */
+		tq.PushBack(qt)
+	}
 
 	for {
+		var outQ chan *o.TaskRequest = nil
+		var outTask *o.TaskRequest = nil
+		if handoffs.Len() > 0 {
+			h,_ := handoffs.Front().Value.(*handoff)
+			outQ = h.player.TaskQ
+			outTask = h.qt.task
+		}
 		select {
+		case outQ <- outTask:
+			handoffs.Remove(handoffs.Front())
 		case player := <-playerIdle:
 			o.Debug("Dispatch: Player")
-			/* first, scan to see if we have anything for this player */
-			i := tq.Front()
-			for {
-				if (nil == i) {
-					/* Out of items! */
-					/* Append this player to the waiting players queue */
-					pq.PushBack(player)
-					break;
-				}
-				t,_ := i.Value.(*o.TaskRequest)
-				if t.IsTarget(player.Player) {
-					/* Found a valid job. Send it to the player, and remove it from our pending 
-					 * list */
-					tq.Remove(i)
-					player.TaskQ <- t
-					break;
-				}
-				i = i.Next()
-			}
+			playerReady(player)
 		case player := <-playerDead:
 			o.Debug("Dispatch: Dead Player")
-			for i := pq.Front(); i != nil; i = i.Next() {
+			/* players with several slots are queued once for each
+			 * free slot, so get rid of all of them. */
+			for i := pq.Front(); i != nil; {
+				next := i.Next()
 				p, _ := i.Value.(*ClientInfo)
 				if player.Player == p.Player {
 					pq.Remove(i)
-					break;
 				}
+				i = next
+			}
+			/* and anything it hadn't picked up yet needs to go
+			 * to someone else. */
+			var orphans []*queuedTask
+			for i := handoffs.Front(); i != nil; {
+				next := i.Next()
+				h,_ := i.Value.(*handoff)
+				if player.Player == h.player.Player {
+					handoffs.Remove(i)
+					h.qt.task.ClaimedBy = ""
+					orphans = append(orphans, h.qt)
+				}
+				i = next
+			}
+			for _, qt := range orphans {
+				taskReady(qt)
 			}
 		case task := <-rqTask:
 			o.Debug("Dispatch: Task")
-			/* first, scan to see if we have valid pending player for this task */
-			i := pq.Front()
-			for {
-				if (nil == i) {
-					/* Out of players! */
-					/* Append this task to the waiting tasks queue */
-					tq.PushBack(task)
-					break;
+			qt := new(queuedTask)
+			qt.task = task
+			qt.since = time.Nanoseconds()
+			taskReady(qt)
+		case wi := <-withdrawRequest:
+			o.Debug("Dispatch: Withdraw")
+			withdrawn := 0
+			for i := tq.Front(); i != nil; {
+				next := i.Next()
+				qt,_ := i.Value.(*queuedTask)
+				t := qt.task
+				if t.Job.Id == wi.id {
+					tq.Remove(i)
+					t.State = o.TASK_FINISHED
+					withdrawn++
 				}
-				p,_ := i.Value.(*ClientInfo)
-				if task.IsTarget(p.Player) {
-					/* Found it. */
-					pq.Remove(i)
-					p.TaskQ <- task
-					break;
+				i = next
+			}
+			/* the players we were about to give them to are
+			 * still waiting for work. */
+			var freed []*ClientInfo
+			for i := handoffs.Front(); i != nil; {
+				next := i.Next()
+				h,_ := i.Value.(*handoff)
+				if h.qt.task.Job.Id == wi.id {
+					handoffs.Remove(i)
+					h.qt.task.ClaimedBy = ""
+					h.qt.task.State = o.TASK_FINISHED
+					withdrawn++
+					freed = append(freed, h.player)
 				}
-				i = i.Next();
+				i = next
+			}
+			for _, player := range freed {
+				playerReady(player)
 			}
+			wi.responseChannel <- withdrawn
 		case respChan := <-statusRequest:
 			o.Debug("Status!")
 			response := new(QueueInformation)
 			response.waitingTasks = tq.Len()
+			response.depths = make(map[int]int)
+			for i := tq.Front(); i != nil; i = i.Next() {
+				qt,_ := i.Value.(*queuedTask)
+				response.depths[qt.task.Job.Priority]++
+			}
 			pqLen := pq.Len()
 			response.idlePlayers = make([]string, pqLen)
 			
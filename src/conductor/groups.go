@@ -0,0 +1,165 @@
+/* groups.go
+ *
+ * Player groups and tags.
+ *
+ * The players file may tag players, and define named groups of them:
+ *
+ *	web1.example.com	role=web dc=syd
+ *	db1.example.com		role=db dc=syd
+ *	@sydney			dc=syd
+ *	@frontline		@sydney role=web other.example.com
+ *
+ * The audience can then ask for '@group' or 'key=value' anywhere it
+ * could name a player, and we expand those out before the job is
+ * split into tasks.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	o "orchestra"
+)
+
+type PlayerDirectory struct {
+	// players in the order they appear in the players file.
+	players		[]string
+	tags		map[string]map[string]bool
+	groups		map[string][]string
+}
+
+var (
+	currentDirectory	*PlayerDirectory = NewPlayerDirectory()
+	directoryLock		sync.Mutex
+)
+
+func NewPlayerDirectory() (pd *PlayerDirectory) {
+	pd = new(PlayerDirectory)
+	pd.tags = make(map[string]map[string]bool)
+	pd.groups = make(map[string][]string)
+
+	return pd
+}
+
+func isTag(ref string) bool {
+	return strings.Index(ref, "=") > 0
+}
+
+func isGroup(ref string) bool {
+	return len(ref) > 1 && ref[0] == '@'
+}
+
+// Add a line from the players file.  Returns false if the line
+// doesn't make sense.
+func (pd *PlayerDirectory) AddLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	if isGroup(fields[0]) {
+		name := fields[0][1:]
+		pd.groups[name] = append(pd.groups[name], fields[1:]...)
+		return true
+	}
+	if isTag(fields[0]) || fields[0][0] == '@' {
+		return false
+	}
+	// check the whole line before we add anything, so a bad line
+	// doesn't leave half a player behind.
+	for _, tag := range fields[1:] {
+		if !isTag(tag) {
+			return false
+		}
+	}
+	player := fields[0]
+	if _, exists := pd.tags[player]; !exists {
+		pd.players = append(pd.players, player)
+		pd.tags[player] = make(map[string]bool)
+	}
+	for _, tag := range fields[1:] {
+		pd.tags[player][tag] = true
+	}
+	return true
+}
+
+func (pd *PlayerDirectory) Players() []string {
+	return pd.players
+}
+
+// expand a single reference, appending the players to out.  seen
+// tracks which groups we're in the middle of so loops are caught.
+func (pd *PlayerDirectory) expand(ref string, out *[]string, seen map[string]bool) (reason string) {
+	switch {
+	case isGroup(ref):
+		name := ref[1:]
+		members, exists := pd.groups[name]
+		if !exists {
+			return "Unknown Group"
+		}
+		if seen[name] {
+			o.Warn("Player group @%s includes itself", name)
+			return "Invalid Group"
+		}
+		seen[name] = true
+		for _, member := range members {
+			reason = pd.expand(member, out, seen)
+			if reason != "" {
+				return reason
+			}
+		}
+		seen[name] = false, false
+	case isTag(ref):
+		found := false
+		for _, player := range pd.players {
+			if pd.tags[player][ref] {
+				*out = append(*out, player)
+				found = true
+			}
+		}
+		if !found {
+			return "Unknown Tag"
+		}
+	default:
+		*out = append(*out, ref)
+	}
+	return ""
+}
+
+// Expand a list of players, groups and tags into the players they
+// refer to.  If any of them can't be expanded, players is nil and
+// reason says why.
+func (pd *PlayerDirectory) Expand(refs []string) (players []string, reason string) {
+	var expanded []string
+	for _, ref := range refs {
+		reason = pd.expand(ref, &expanded, make(map[string]bool))
+		if reason != "" {
+			o.Warn("Couldn't expand player reference \"%s\": %s", ref, reason)
+			return nil, reason
+		}
+	}
+	// remove any duplicates.
+	dup := make(map[string]bool)
+	for _, player := range expanded {
+		if !dup[player] {
+			dup[player] = true
+			players = append(players, player)
+		}
+	}
+	return players, ""
+}
+
+func SetPlayerDirectory(pd *PlayerDirectory) {
+	directoryLock.Lock()
+	defer directoryLock.Unlock()
+
+	currentDirectory = pd
+}
+
+func ExpandPlayers(refs []string) (players []string, reason string) {
+	directoryLock.Lock()
+	pd := currentDirectory
+	directoryLock.Unlock()
+
+	return pd.Expand(refs)
+}
@@ -1,6 +1,6 @@
 /* http.go
  *
- * HTTP status server.
+ * HTTP status server, and the REST flavour of the audience interface.
 */
 
 package main
@@ -8,6 +8,10 @@ package main
 import (
 	"fmt"
 	"http"
+	"json"
+	"sort"
+	"strconv"
+	"strings"
 	"orchestra"
 )
 
@@ -18,22 +22,305 @@ func StartHTTP() {
 }
 
 func returnStatus(w http.ResponseWriter, r *http.Request) {
-	tasks, players := DispatchStatus()
+	tasks, players, depths := DispatchStatus()
 	fmt.Fprintf(w, "<p>Tasks Waiting: %d</p>\n", tasks)
+	if len(depths) > 0 {
+		prios := make([]int, 0, len(depths))
+		for prio, _ := range depths {
+			prios = append(prios, prio)
+		}
+		sort.Ints(prios)
+		fmt.Fprintf(w, "<p>By Priority:</p>\n<ul>\n")
+		for i := len(prios) - 1; i >= 0; i-- {
+			fmt.Fprintf(w, "<li>%d: %d</li>\n", prios[i], depths[prios[i]])
+		}
+		fmt.Fprintf(w, "</ul>\n")
+	}
 	fmt.Fprintf(w, "<p>Players Idle:</p>\n<ul>\n")
-	var i int
-	for i = 0; i < len(players); i++ {
-		fmt.Fprintf(w, "<li>%s</li>\n", players[i])
+	free := make(map[string]int)
+	var names []string
+	for _, name := range players {
+		if free[name] == 0 {
+			names = append(names, name)
+		}
+		free[name]++
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "<li>%s (%d free)</li>\n", name, free[name])
 	}
-	if (i == 0) {
+	if (len(names) == 0) {
 		fmt.Fprintf(w, "<li>none</li>")
 	}
 	fmt.Fprintf(w, "</ul>")
 }
 
+type JsonPlayerInfo struct {
+	Name		string
+	Connected	bool
+	Idle		bool
+	// how many more tasks the player is ready for.
+	FreeSlots	int
+	PendingTasks	int
+}
+
+// send a [error, payload] response back, the same as we would over
+// the audience socket.
+func returnJson(w http.ResponseWriter, code int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(resp)
+	if nil != err {
+		orchestra.Warn("Couldn't encode response to HTTP audience: %s", err)
+	}
+}
+
+func returnJsonError(w http.ResponseWriter, code int, reason string) {
+	jresp := new([2]interface{})
+	jresp[0] = "Error"
+	jresp[1] = reason
+	returnJson(w, code, jresp)
+}
+
+// the API is off unless the administrator has asked for it - there's
+// no authentication on this listener.
+func apiEnabled(w http.ResponseWriter) bool {
+	if !GetBoolOpt("http audience api") {
+		returnJsonError(w, http.StatusForbidden, "HTTP Audience API Disabled")
+		return false
+	}
+	return true
+}
+
+// map an audience error reason onto a HTTP status.
+func errorStatus(reason interface{}) int {
+	switch reason {
+	case "Expired":
+		return http.StatusGone
+	case "Job Already Finished":
+		return http.StatusConflict
+	case nil:
+		fallthrough
+	case "Unknown Job":
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// GET /jobs - list jobs.  POST /jobs - queue a job.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !apiEnabled(w) {
+		return
+	}
+	var op string
+	var req *GenericJsonRequest = nil
+	var auditId uint64 = 0
+	result := "OK"
+	defer func() {
+		if op != "" {
+			AuditRequest(nil, r.RemoteAddr, op, req, auditId, result)
+		}
+	}()
+	fail := func(code int, reason string) {
+		result = reason
+		returnJsonError(w, code, reason)
+	}
+
+	switch r.Method {
+	case "GET":
+		op = "list"
+		var reason string
+		req, reason = listRequestFromForm(r)
+		if nil == req {
+			fail(http.StatusBadRequest, reason)
+			return
+		}
+		filter, reason := req.MakeFilter()
+		if nil == filter {
+			fail(http.StatusBadRequest, reason)
+			return
+		}
+		returnJson(w, http.StatusOK, jobListResponse(filter))
+	case "POST":
+		op = "queue"
+		req = new(GenericJsonRequest)
+		dec := json.NewDecoder(r.Body)
+		err := dec.Decode(req)
+		if err != nil {
+			orchestra.Warn("Error decoding JSON talking to HTTP audience: %s", err)
+			req = nil
+			fail(http.StatusBadRequest, "Malformed Request")
+			return
+		}
+		job, reason := req.MakeJob()
+		if nil == job {
+			fail(http.StatusBadRequest, reason)
+			return
+		}
+		// we don't know who HTTP clients are.
+		if !JobPermitted(nil, job) {
+			fail(http.StatusForbidden, "Forbidden")
+			return
+		}
+		QueueJob(job)
+		auditId = job.Id
+		jresp := new([2]interface{})
+		jresp[0] = "OK"
+		jresp[1] = job.Id
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.Id))
+		returnJson(w, http.StatusCreated, jresp)
+	default:
+		returnJsonError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// GET /jobs/{id} - job status.  DELETE /jobs/{id} - cancel the job.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if !apiEnabled(w) {
+		return
+	}
+	id, err := strconv.Atoui64(r.URL.Path[len("/jobs/"):])
+	if err != nil {
+		returnJsonError(w, http.StatusNotFound, "Unknown Job")
+		return
+	}
+	var op string
+	result := "OK"
+	defer func() {
+		if op != "" {
+			AuditRequest(nil, r.RemoteAddr, op, nil, id, result)
+		}
+	}()
+	fail := func(code int, reason string) {
+		result = reason
+		returnJsonError(w, code, reason)
+	}
+
+	switch r.Method {
+	case "GET":
+		op = "status"
+		// ?wait=<seconds> holds the request until the job finishes.
+		if wait := r.FormValue("wait"); wait != "" {
+			op = "wait"
+			timeout, err := strconv.Atoi64(wait)
+			if err != nil || timeout < 0 {
+				fail(http.StatusBadRequest, "Invalid Timeout")
+				return
+			}
+			waitForJob(id, timeout)
+		}
+		jresp := jobStatusResponse(id)
+		result = statusResult(jresp)
+		if jresp[0] != "OK" {
+			returnJson(w, errorStatus(jresp[1]), jresp)
+			return
+		}
+		returnJson(w, http.StatusOK, jresp)
+	case "DELETE":
+		op = "cancel"
+		job := orchestra.JobGet(id)
+		if nil != job && !JobPermitted(nil, job) {
+			fail(http.StatusForbidden, "Forbidden")
+			return
+		}
+		ok, reason := CancelJob(id)
+		if !ok {
+			fail(errorStatus(reason), reason)
+			return
+		}
+		jresp := new([2]interface{})
+		jresp[0] = "OK"
+		jresp[1] = id
+		returnJson(w, http.StatusOK, jresp)
+	default:
+		returnJsonError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// GET /players - the players we know about, and what they're doing.
+func handlePlayers(w http.ResponseWriter, r *http.Request) {
+	if !apiEnabled(w) {
+		return
+	}
+	if r.Method != "GET" {
+		returnJsonError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	_, idlePlayers, _ := DispatchStatus()
+	idle := make(map[string]int)
+	for _, name := range idlePlayers {
+		idle[name]++
+	}
+	names := ClientList()
+	players := make([]*JsonPlayerInfo, 0, len(names))
+	for _, name := range names {
+		state, ok := ClientGetState(name)
+		if !ok {
+			// went away whilst we were looking.
+			continue
+		}
+		pi := new(JsonPlayerInfo)
+		pi.Name = name
+		pi.Connected = state.Connected
+		pi.Idle = idle[name] > 0
+		pi.FreeSlots = idle[name]
+		pi.PendingTasks = state.PendingTasks
+		players = append(players, pi)
+	}
+	jresp := new([2]interface{})
+	jresp[0] = "OK"
+	jresp[1] = players
+	returnJson(w, http.StatusOK, jresp)
+}
+
+// build a list request from the query string.
+func listRequestFromForm(r *http.Request) (req *GenericJsonRequest, reason string) {
+	req = new(GenericJsonRequest)
+	if v := r.FormValue("state"); v != "" {
+		req.States = strings.Split(v, ",")
+	}
+	if v := r.FormValue("score"); v != "" {
+		req.Score = &v
+	}
+	if v := r.FormValue("player"); v != "" {
+		req.Player = &v
+	}
+	if v := r.FormValue("since"); v != "" {
+		since, err := strconv.Atoi64(v)
+		if err != nil {
+			return nil, "Invalid Since"
+		}
+		req.Since = &since
+	}
+	if v := r.FormValue("until"); v != "" {
+		until, err := strconv.Atoi64(v)
+		if err != nil {
+			return nil, "Invalid Until"
+		}
+		req.Until = &until
+	}
+	if v := r.FormValue("cursor"); v != "" {
+		cursor, err := strconv.Atoui64(v)
+		if err != nil {
+			return nil, "Invalid Cursor"
+		}
+		req.Cursor = &cursor
+	}
+	if v := r.FormValue("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, "Invalid Limit"
+		}
+		req.Limit = &limit
+	}
+	return req, ""
+}
+
 func httpServer() {
 	laddr := fmt.Sprintf(":%d", orchestra.DefaultHTTPPort)
 	http.HandleFunc("/", returnStatus)
+	http.HandleFunc("/jobs", handleJobs)
+	http.HandleFunc("/jobs/", handleJob)
+	http.HandleFunc("/players", handlePlayers)
 	http.ListenAndServe(laddr, nil)
 }
-
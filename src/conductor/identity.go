@@ -0,0 +1,75 @@
+/* identity.go
+ *
+ * Working out who is on the other end of an audience connection.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The identity of an audience client.  A nil Identity is an anonymous
+// client - we have no idea who they are.
+type Identity struct {
+	// set for local connections where we could read the peer's
+	// credentials.
+	HaveCreds	bool
+	Uid		int
+	Gid		int
+	// the certificate subject for TLS connections.
+	Subject		string
+}
+
+func (who *Identity) String() string {
+	if nil == who {
+		return ""
+	}
+	if who.HaveCreds {
+		return fmt.Sprintf("uid=%d gid=%d", who.Uid, who.Gid)
+	}
+	return who.Subject
+}
+
+// Get the credentials of the process on the other end of a unix
+// socket.
+//
+// This is Linux specific (SO_PEERCRED).
+func peerIdentity(c net.Conn) (who *Identity, err os.Error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, os.NewError("not a unix socket")
+	}
+	// there's no way to get at the connection's own descriptor, so
+	// we have to use File(), which dups it and puts it into blocking
+	// mode.  The dup shares the original's file status flags, so
+	// putting it straight back into non-blocking mode fixes the
+	// connection too.
+	f, err := uc.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if errno := syscall.SetNonblock(f.Fd(), true); errno != 0 {
+		return nil, os.NewError("couldn't restore non-blocking mode: " + os.Errno(errno).String())
+	}
+
+	var cred syscall.Ucred
+	credLen := uint32(unsafe.Sizeof(cred))
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(f.Fd()),
+		syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&credLen)), 0)
+	if e != 0 {
+		return nil, os.Errno(e)
+	}
+	who = new(Identity)
+	who.HaveCreds = true
+	who.Uid = int(cred.Uid)
+	who.Gid = int(cred.Gid)
+
+	return who, nil
+}
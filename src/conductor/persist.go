@@ -0,0 +1,282 @@
+/* persist.go
+ *
+ * Job state persistence.
+ *
+ * Every job known to the conductor is written out as a JSON record
+ * under the conductor state path whenever it changes, so that job IDs
+ * handed out to the audience survive a restart.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"json"
+	"sync"
+	"strings"
+	"io/ioutil"
+	"bufio"
+	"strconv"
+	"time"
+	o "orchestra"
+)
+
+// the highest job ID we've recorded as expired on disk.
+var savedExpiredMark uint64 = 0
+
+// the ranges of IDs that were skipped over after an unclean shutdown,
+// and so were never handed out.  Only changed while we're starting up.
+var skippedIds [][2]uint64
+
+// serialises writers so that the last snapshot taken is always the
+// last one to hit the disk.
+var persistLock sync.Mutex
+
+func jobStatePath() string {
+	stateDir := strings.TrimSpace(GetStringOpt("conductor state path"))
+	return path.Join(stateDir, "jobs")
+}
+
+func expiredMarkPath() string {
+	stateDir := strings.TrimSpace(GetStringOpt("conductor state path"))
+	return path.Join(stateDir, "expired_id")
+}
+
+func skippedIdsPath() string {
+	stateDir := strings.TrimSpace(GetStringOpt("conductor state path"))
+	return path.Join(stateDir, "skipped_ids")
+}
+
+func jobStateFile(id uint64) string {
+	return path.Join(jobStatePath(), fmt.Sprintf("%d.json", id))
+}
+
+// Write the current state of the job out to disk.
+func SaveJob(id uint64) {
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	rec := o.JobGetRecord(id)
+	if nil == rec {
+		o.Warn("Job %d: Couldn't save state - no such job", id)
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		o.Warn("Job %d: Couldn't encode state: %s", id, err)
+		return
+	}
+	err = os.MkdirAll(jobStatePath(), 0700)
+	if err != nil {
+		o.Warn("Couldn't create job state directory: %s", err)
+		return
+	}
+	// write to a temporary file and rename it over the top so we
+	// never leave a truncated record behind.
+	fname := jobStateFile(id)
+	tmpname := fname + ".tmp"
+	fh, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		o.Warn("Job %d: Couldn't create state file: %s", id, err)
+		return
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err != nil {
+		o.Warn("Job %d: Couldn't write state file: %s", id, err)
+		os.Remove(tmpname)
+		return
+	}
+	err = os.Rename(tmpname, fname)
+	if err != nil {
+		o.Warn("Job %d: Couldn't replace state file: %s", id, err)
+	}
+}
+
+// Remove the record of a job from disk.
+func DeleteJob(id uint64) {
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	err := os.Remove(jobStateFile(id))
+	if err != nil {
+		o.Warn("Job %d: Couldn't remove state file: %s", id, err)
+	}
+}
+
+func saveExpiredMark(id uint64) {
+	fh, err := os.OpenFile(expiredMarkPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		o.Warn("Failed to save expired job mark: %s", err)
+		return
+	}
+	defer fh.Close()
+	fmt.Fprintf(fh, "%d\n", id)
+}
+
+func loadExpiredMark() {
+	fh, err := os.Open(expiredMarkPath())
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	cbio := bufio.NewReader(fh)
+	l, err := cbio.ReadString('\n')
+	id, err := strconv.Atoui64(strings.TrimSpace(l))
+	if err != nil {
+		o.Warn("Couldn't read expired job mark: %s", err)
+		return
+	}
+	savedExpiredMark = id
+	o.JobSetExpiredMark(id)
+}
+
+func loadSkippedIds() {
+	skippedIds = nil
+	data, err := ioutil.ReadFile(skippedIdsPath())
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		start, err1 := strconv.Atoui64(fields[0])
+		end, err2 := strconv.Atoui64(fields[1])
+		if err1 != nil || err2 != nil {
+			o.Warn("Ignoring malformed skipped ID range \"%s\"", line)
+			continue
+		}
+		skippedIds = append(skippedIds, [2]uint64{start, end})
+	}
+}
+
+// Note that the IDs from start to end (inclusive) will never be used.
+func recordSkippedIds(start, end uint64) {
+	skippedIds = append(skippedIds, [2]uint64{start, end})
+	fh, err := os.OpenFile(skippedIdsPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		o.Warn("Failed to save skipped job IDs: %s", err)
+		return
+	}
+	defer fh.Close()
+	fmt.Fprintf(fh, "%d %d\n", start, end)
+}
+
+// true if the job was evicted under the retention policy.  IDs that
+// were never handed out don't count, even if they're below the
+// expired mark.
+func JobExpired(id uint64) bool {
+	for _, r := range skippedIds {
+		if id >= r[0] && id <= r[1] {
+			return false
+		}
+	}
+	return o.JobExpired(id)
+}
+
+const ExpiryInterval = 60e9 // check for expired jobs every minute.
+
+// Evict jobs that have fallen outside the retention policy.
+func ExpireJobs() {
+	maxAge := int64(GetIntOpt("job retention age")) * 1e9
+	maxCount := GetIntOpt("job retention count")
+
+	ExpireWorkflowRuns(maxAge)
+
+	ids := o.JobExpire(maxAge, maxCount)
+	if len(ids) == 0 {
+		return
+	}
+	mark := savedExpiredMark
+	for _, id := range ids {
+		o.Debug("Job %d: Expired", id)
+		DeleteJob(id)
+		if id > mark {
+			mark = id
+		}
+	}
+	if mark > savedExpiredMark {
+		saveExpiredMark(mark)
+		savedExpiredMark = mark
+	}
+	o.Info("Expired %d jobs", len(ids))
+}
+
+func expiryLoop() {
+	for {
+		ExpireJobs()
+		time.Sleep(ExpiryInterval)
+	}
+}
+
+func StartJobExpiry() {
+	go expiryLoop()
+}
+
+// Replay the saved jobs into the registry.  Returns the tasks that
+// still need to be handed to dispatch.
+func LoadJobs() (tasks []*o.TaskRequest) {
+	loadExpiredMark()
+
+	files, err := ioutil.ReadDir(jobStatePath())
+	if err != nil {
+		pe, ok := err.(*os.PathError)
+		if !ok || pe.Error != os.ENOENT {
+			o.Warn("Couldn't read job state directory: %s", err)
+		}
+		return nil
+	}
+	for _, fi := range files {
+		if !fi.IsRegular() || !strings.HasSuffix(fi.Name, ".json") {
+			continue
+		}
+		fname := path.Join(jobStatePath(), fi.Name)
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			o.Warn("Couldn't read job state file %s: %s", fname, err)
+			continue
+		}
+		rec := new(o.JobRecord)
+		err = json.Unmarshal(data, rec)
+		if err != nil {
+			o.Warn("Couldn't decode job state file %s: %s", fname, err)
+			continue
+		}
+		job := o.JobFromRecord(rec)
+		if !o.JobAdd(job) {
+			o.Warn("Couldn't register restored job %d", job.Id)
+			continue
+		}
+		// make sure we never hand out an ID we've already used.
+		// this runs before the audience listener starts, so
+		// nobody else is allocating IDs yet.
+		if job.Id > lastId {
+			lastId = job.Id
+		}
+		for _, task := range job.Tasks {
+			switch task.State {
+			case o.TASK_QUEUED:
+				fallthrough
+			case o.TASK_PENDINGRESULT:
+				tasks = append(tasks, task)
+			}
+		}
+		if jobAwaitingRelease(job) {
+			RegisterDependencies(job)
+			DelayJob(job.Id, job.NotBefore)
+		}
+		// we might have gone down just as a batch finished.
+		AdvanceRollout(job.Id)
+		o.Info("Restored Job %d", job.Id)
+	}
+	writeIdCheckpoint()
+
+	return tasks
+}
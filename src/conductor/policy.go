@@ -0,0 +1,216 @@
+/* policy.go
+ *
+ * Audience authorisation policy.
+ *
+ * The policy file lists which scores an audience client may run, on
+ * which players, and with which scopes.  Each line is a rule:
+ *
+ *	identity : scores : players : scopes
+ *
+ * identity is one of 'uid=N' or 'gid=N' (local clients), a certificate
+ * subject (remote clients), or '*' for anyone at all.  The other fields
+ * are lists of patterns (separated by spaces or commas) in the style of
+ * path.Match.
+ *
+ * A job is allowed if any one rule that matches the submitter allows
+ * the score, every player and the scope.  If no policy file is
+ * configured, everything is allowed.
+*/
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	o "orchestra"
+)
+
+type PolicyRule struct {
+	Identity	string
+	Scores		[]string
+	Players		[]string
+	Scopes		[]string
+}
+
+type Policy struct {
+	Rules		[]*PolicyRule
+}
+
+var (
+	currentPolicy	*Policy = nil
+	policyLock	sync.Mutex
+)
+
+func splitPatterns(field string) (patterns []string) {
+	field = strings.Replace(field, ",", " ", -1)
+	return strings.Fields(field)
+}
+
+// parse a single policy line.  We split from the right so that
+// certificate subjects may contain colons.
+func parsePolicyRule(line string) (rule *PolicyRule, err os.Error) {
+	fields := make([]string, 4)
+	for i := 3; i > 0; i-- {
+		idx := strings.LastIndex(line, ":")
+		if idx < 0 {
+			return nil, os.NewError("not enough fields")
+		}
+		fields[i] = line[idx+1:]
+		line = line[:idx]
+	}
+	fields[0] = line
+
+	rule = new(PolicyRule)
+	rule.Identity = strings.TrimSpace(fields[0])
+	if rule.Identity == "" {
+		return nil, os.NewError("missing identity")
+	}
+	rule.Scores = splitPatterns(fields[1])
+	rule.Players = splitPatterns(fields[2])
+	rule.Scopes = splitPatterns(fields[3])
+	for _, list := range [][]string{rule.Scores, rule.Players, rule.Scopes} {
+		for _, pattern := range list {
+			// catch bad patterns now rather than at match time.
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, os.NewError("bad pattern \"" + pattern + "\"")
+			}
+		}
+	}
+	return rule, nil
+}
+
+func LoadPolicy(filename string) (policy *Policy, err os.Error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	policy = new(Policy)
+	pbr := bufio.NewReader(fh)
+	lineno := 0
+	for err = nil; err == nil; {
+		var lb		[]byte
+		var prefix	bool
+
+		lb, prefix, err = pbr.ReadLine()
+		if nil == lb {
+			break
+		}
+		lineno++
+		if prefix {
+			return nil, os.NewError("line too long")
+		}
+		line := strings.TrimSpace(string(lb))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rule, perr := parsePolicyRule(line)
+		if perr != nil {
+			return nil, os.NewError(filename + ":" + strconv.Itoa(lineno) + ": " + perr.String())
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+func SetPolicy(policy *Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+
+	currentPolicy = policy
+}
+
+func GetPolicy() *Policy {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+
+	return currentPolicy
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		matched, _ := path.Match(pattern, value)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *PolicyRule) matchesIdentity(who *Identity) bool {
+	if rule.Identity == "*" {
+		return true
+	}
+	if nil == who {
+		return false
+	}
+	if who.HaveCreds {
+		switch {
+		case strings.HasPrefix(rule.Identity, "uid="):
+			uid, err := strconv.Atoi(rule.Identity[len("uid="):])
+			return err == nil && uid == who.Uid
+		case strings.HasPrefix(rule.Identity, "gid="):
+			gid, err := strconv.Atoi(rule.Identity[len("gid="):])
+			return err == nil && gid == who.Gid
+		}
+		return false
+	}
+	return who.Subject != "" && rule.Identity == who.Subject
+}
+
+func (rule *PolicyRule) permits(job *o.JobRequest) bool {
+	if !matchAny(rule.Scores, job.Score) {
+		return false
+	}
+	if !matchAny(rule.Scopes, scopeNames[job.Scope]) {
+		return false
+	}
+	for _, player := range job.Players {
+		if !matchAny(rule.Players, player) {
+			return false
+		}
+	}
+	return true
+}
+
+func (policy *Policy) Permits(who *Identity, job *o.JobRequest) bool {
+	for _, rule := range policy.Rules {
+		if rule.matchesIdentity(who) && rule.permits(job) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the submitter allowed to remove the schedule?  Only if they'd be
+// allowed to queue the job it makes.
+func schedulePermitted(who *Identity, sched *Schedule) bool {
+	if nil == GetPolicy() {
+		return true
+	}
+	job, _ := sched.Request.MakeJob()
+	if nil == job {
+		o.Warn("Schedule %d: Can't check policy - job is no longer valid", sched.Id)
+		return false
+	}
+	return JobPermitted(who, job)
+}
+
+// Is the submitter allowed to run (or interfere with) this job?
+func JobPermitted(who *Identity, job *o.JobRequest) bool {
+	policy := GetPolicy()
+	if nil == policy {
+		return true
+	}
+	if !policy.Permits(who, job) {
+		o.Warn("Forbidden: \"%s\" may not run %s (%s) on %v", who, job.Score, scopeName(job), job.Players)
+		return false
+	}
+	return true
+}
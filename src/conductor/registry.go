@@ -11,6 +11,7 @@ package main
 
 import (
 	o "orchestra"
+	"sort"
 )
 
 
@@ -20,23 +21,40 @@ const (
 	requestGetClient
 	requestDeleteClient
 	requestSyncClients
+	requestListClients
+	requestSetClientConnected
+	requestSetClientPending
+	requestGetClientState
 )
 
+// What a client is up to, as last reported by its client goroutine.
+// The ClientInfo itself belongs to that goroutine, so this is what
+// everyone else should look at.
+type ClientState struct {
+	Connected	bool
+	PendingTasks	int
+}
+
 type registryRequest struct {
 	operation		int
 	hostname		string
 	hostlist		[]string
+	connected		bool
+	pending			int
 	responseChannel		chan *registryResponse
 }
 
 type registryResponse struct {
 	success			bool
 	info			*ClientInfo
+	state			ClientState
+	names			[]string
 }
 
 var (
 	chanRegistryRequest	= make(chan *registryRequest)
  	clientList 		= make(map[string]*ClientInfo)
+	clientStates		= make(map[string]*ClientState)
 )
 
 func regInternalAdd(hostname string) {
@@ -45,12 +63,14 @@ func regInternalAdd(hostname string) {
 	// do this initialisation here since it'll help unmask sequencing errors
 	clientList[hostname].pendingTasks = make(map[uint64]*o.TaskRequest)
 	clientList[hostname].Player = hostname
+	clientStates[hostname] = new(ClientState)
 }
 
 func regInternalDel(hostname string) {
 	o.Warn("Registry: Deleting Host \"%s\"", hostname)
 	/* remove it from the registry */
 	clientList[hostname] = nil, false
+	clientStates[hostname] = nil, false
 }
 
 func manageRegistry() {
@@ -114,6 +134,31 @@ func manageRegistry() {
 				regInternalAdd(k)
 			}
 			/* and we're done. */
+		case requestListClients:
+			resp.names = make([]string, 0, len(clientList))
+			for k,_ := range clientList {
+				resp.names = append(resp.names, k)
+			}
+			sort.Strings(resp.names)
+			resp.success = true
+		case requestSetClientConnected:
+			state, exists := clientStates[req.hostname]
+			if exists {
+				state.Connected = req.connected
+				resp.success = true
+			}
+		case requestSetClientPending:
+			state, exists := clientStates[req.hostname]
+			if exists {
+				state.PendingTasks = req.pending
+				resp.success = true
+			}
+		case requestGetClientState:
+			state, exists := clientStates[req.hostname]
+			if exists {
+				resp.state = *state
+				resp.success = true
+			}
 		}
 		if req.responseChannel != nil {
 			req.responseChannel <- resp
@@ -164,6 +209,16 @@ func ClientGet(hostname string) (info *ClientInfo) {
 	return nil
 }
 
+// Get the names of all the players we know about, sorted.
+func ClientList() (hostnames []string) {
+	r := newRequest()
+	r.operation = requestListClients
+	chanRegistryRequest <- r
+	resp := <- r.responseChannel
+
+	return resp.names
+}
+
 func ClientUpdateKnown(hostnames []string) {
 	/* this is an asynchronous, we feed it into the registry 
 	 * and it'll look after itself.
@@ -173,3 +228,31 @@ func ClientUpdateKnown(hostnames []string) {
 	r.hostlist = hostnames
 	chanRegistryRequest <- r
 }
+
+// Record whether the player is connected.  Asynchronous.
+func ClientSetConnected(hostname string, connected bool) {
+	r := newRequest()
+	r.operation = requestSetClientConnected
+	r.hostname = hostname
+	r.connected = connected
+	chanRegistryRequest <- r
+}
+
+// Record how many tasks the player has outstanding.  Asynchronous.
+func ClientSetPending(hostname string, pending int) {
+	r := newRequest()
+	r.operation = requestSetClientPending
+	r.hostname = hostname
+	r.pending = pending
+	chanRegistryRequest <- r
+}
+
+func ClientGetState(hostname string) (state ClientState, ok bool) {
+	r := newRequest()
+	r.operation = requestGetClientState
+	r.hostname = hostname
+	chanRegistryRequest <- r
+	resp := <- r.responseChannel
+
+	return resp.state, resp.success
+}
@@ -0,0 +1,120 @@
+/* rollout.go
+ *
+ * Rolling execution of all-of jobs.
+ *
+ * A rolling job only releases Batch of its tasks to dispatch at a time.
+ * The rest are held back until the released batch has finished.  The
+ * first batch acts as a canary - if the job racks up more failures than
+ * its budget allows, the held tasks are never run and are marked as
+ * skipped instead.
+*/
+
+package main
+
+import (
+	"sync"
+	o "orchestra"
+)
+
+// stops two results for the same job releasing the next batch twice.
+var rolloutLock sync.Mutex
+
+// Hold back everything but the first batch.  This must be done before
+// the job is registered.
+func HoldTasks(job *o.JobRequest) {
+	if job.Batch <= 0 {
+		return
+	}
+	for i, task := range job.Tasks {
+		if i >= job.Batch {
+			task.State = o.TASK_HELD
+		}
+	}
+}
+
+// Work out what to do next with a rolling job.  Called whenever the
+// job gets a result.
+func AdvanceRollout(id uint64) {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	job := o.JobGet(id)
+	if nil == job || job.Batch <= 0 || job.Cancelled || jobAwaitingRelease(job) {
+		return
+	}
+	held := 0
+	running := 0
+	for _, task := range job.Tasks {
+		switch task.State {
+		case o.TASK_HELD:
+			held++
+		case o.TASK_QUEUED:
+			fallthrough
+		case o.TASK_PENDINGRESULT:
+			running++
+		}
+	}
+	if held == 0 {
+		return
+	}
+	failures := 0
+	for _, name := range o.JobGetResultNames(id) {
+		tr := o.JobGetResult(id, name)
+		if nil != tr && tr.DidFail() && tr.State != o.RESP_SKIPPED {
+			failures++
+		}
+	}
+	if failures > job.FailureBudget {
+		o.Warn("Job %d: %d failures exceeds budget of %d.  Halting rollout.", id, failures, job.FailureBudget)
+		haltRollout(job)
+		return
+	}
+	if running > 0 {
+		// the current batch is still going.
+		return
+	}
+
+	var released []*o.TaskRequest
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_HELD && len(released) < job.Batch {
+			task.State = o.TASK_QUEUED
+			released = append(released, task)
+		}
+	}
+	o.Info("Job %d: Releasing %d more tasks (%d held)", id, len(released), held - len(released))
+	SaveJob(id)
+	for _, task := range released {
+		DispatchTask(task)
+	}
+}
+
+// mark all the held tasks as skipped.
+func haltRollout(job *o.JobRequest) {
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_HELD {
+			tr := o.NewTaskResponse()
+			tr.Id = job.Id
+			tr.State = o.RESP_SKIPPED
+			tr.Response["reason"] = "rollout halted"
+			o.JobAddResult(task.Player, tr)
+			task.State = o.TASK_FINISHED
+		}
+	}
+	o.JobReviewState(job.Id)
+	SaveJob(job.Id)
+}
+
+// Throw away a job's held tasks without recording a result for them.
+// Returns how many there were.
+func DropHeldTasks(job *o.JobRequest) (dropped int) {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_HELD {
+			task.State = o.TASK_FINISHED
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,368 @@
+/* schedule.go
+ *
+ * Delayed and recurring jobs.
+ *
+ * A job queued with a NotBefore time is registered straight away (so it
+ * has an ID and a status), but all of its tasks are held until it's
+ * due.
+ *
+ * Recurring schedules are queue requests with a cron spec attached.
+ * Each time a schedule fires, the request is queued as an ordinary
+ * job.  Schedules are kept in schedules.json under the conductor state
+ * path so they survive a restart - but firings that were missed whilst
+ * we were down are not made up.
+*/
+
+package main
+
+import (
+	"json"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"io/ioutil"
+	o "orchestra"
+)
+
+type Schedule struct {
+	Id		uint64
+	Cron		string
+	// the queue request to make each time the schedule fires.
+	Request		*GenericJsonRequest
+	Submitter	string
+	// times are in seconds since the epoch.
+	Created		int64
+	Next		int64
+	LastRun		int64
+	// the job ID the schedule last produced.
+	LastJob		uint64
+	spec		*CronSpec
+}
+
+var (
+	schedules	= make(map[uint64]*Schedule)
+	lastScheduleId	uint64 = 0
+	// delayed jobs, and when they're due (in ns).
+	delayedJobs	= make(map[uint64]int64)
+	scheduleLock	sync.Mutex
+	// poked whenever something new might need to be run sooner.
+	scheduleWake	= make(chan bool, 1)
+)
+
+// the longest we'll sleep between checks.
+const ScheduleMaxSleep = 60e9
+
+func schedulePath() string {
+	return path.Join(GetStringOpt("conductor state path"), "schedules.json")
+}
+
+func wakeScheduler() {
+	select {
+	case scheduleWake <- true:
+	default:
+	}
+}
+
+// Write out all the schedules.  Must be called with scheduleLock held.
+func saveSchedules() {
+	list := make([]*Schedule, 0, len(schedules))
+	for _, sched := range schedules {
+		list = append(list, sched)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		o.Warn("Couldn't encode schedules: %s", err)
+		return
+	}
+	err = os.MkdirAll(GetStringOpt("conductor state path"), 0700)
+	if err != nil {
+		o.Warn("Couldn't create conductor state directory: %s", err)
+		return
+	}
+	fname := schedulePath()
+	tmpname := fname + ".tmp"
+	err = ioutil.WriteFile(tmpname, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpname, fname)
+	}
+	if err != nil {
+		o.Warn("Couldn't save schedules: %s", err)
+		os.Remove(tmpname)
+	}
+}
+
+func loadSchedules() {
+	data, err := ioutil.ReadFile(schedulePath())
+	if err != nil {
+		pe, ok := err.(*os.PathError)
+		if !ok || pe.Error != os.ENOENT {
+			o.Warn("Couldn't read schedules: %s", err)
+		}
+		return
+	}
+	var list []*Schedule
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		o.Warn("Couldn't decode schedules: %s", err)
+		return
+	}
+	now := time.Seconds()
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	for _, sched := range list {
+		sched.spec, err = ParseCron(sched.Cron)
+		if err != nil {
+			o.Warn("Schedule %d: Bad cron spec \"%s\": %s", sched.Id, sched.Cron, err)
+			continue
+		}
+		sched.Next = sched.spec.Next(now)
+		schedules[sched.Id] = sched
+		if sched.Id > lastScheduleId {
+			lastScheduleId = sched.Id
+		}
+	}
+}
+
+// Hold the job until notBefore (ns).  The job must already be queued,
+// with all of its tasks held.
+func DelayJob(id uint64, notBefore int64) {
+	scheduleLock.Lock()
+	delayedJobs[id] = notBefore
+	scheduleLock.Unlock()
+
+	wakeScheduler()
+}
+
+// true if the job is a delayed or dependent job that hasn't been
+// released yet.
+func jobAwaitingRelease(job *o.JobRequest) bool {
+	if (job.NotBefore == 0 && len(job.DependsOn) == 0) || job.Cancelled || job.DependencyFailed {
+		return false
+	}
+	for _, task := range job.Tasks {
+		if task.State != o.TASK_HELD {
+			return false
+		}
+	}
+	return true
+}
+
+// Let a delayed or dependent job loose, if it's ready.
+func releaseJob(id uint64) {
+	job := o.JobGet(id)
+	if nil == job || !jobAwaitingRelease(job) {
+		return
+	}
+	if job.NotBefore > time.Nanoseconds() {
+		// the scheduler will be back for it.
+		return
+	}
+	ready, failed := dependencyState(job)
+	if !ready {
+		// we'll be back when the next dependency finishes.
+		return
+	}
+	if failed {
+		failDependency(job)
+		return
+	}
+
+	rolloutLock.Lock()
+	if !jobAwaitingRelease(job) {
+		// somebody beat us to it.
+		rolloutLock.Unlock()
+		return
+	}
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_HELD {
+			task.State = o.TASK_QUEUED
+		}
+	}
+	// it might be a rolling job.
+	HoldTasks(job)
+	rolloutLock.Unlock()
+
+	o.Info("Job %d: Releasing held job", id)
+	SaveJob(id)
+	for _, task := range job.Tasks {
+		if task.State == o.TASK_QUEUED {
+			DispatchTask(task)
+		}
+	}
+}
+
+// Add a recurring schedule.  Returns the schedule's ID.
+func AddSchedule(cron string, spec *CronSpec, req *GenericJsonRequest, submitter string) uint64 {
+	sched := new(Schedule)
+	sched.Cron = cron
+	sched.spec = spec
+	sched.Request = req
+	sched.Request.Op = nil
+	sched.Request.Cron = nil
+	sched.Request.NotBefore = nil
+	sched.Submitter = submitter
+	sched.Created = time.Seconds()
+	sched.Next = spec.Next(sched.Created)
+
+	scheduleLock.Lock()
+	lastScheduleId++
+	sched.Id = lastScheduleId
+	schedules[sched.Id] = sched
+	saveSchedules()
+	scheduleLock.Unlock()
+
+	o.Info("Schedule %d: Added \"%s\" for %s", sched.Id, cron, submitter)
+	wakeScheduler()
+
+	return sched.Id
+}
+
+func GetSchedule(id uint64) *Schedule {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	return schedules[id]
+}
+
+func RemoveSchedule(id uint64) bool {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	_, exists := schedules[id]
+	if !exists {
+		return false
+	}
+	schedules[id] = nil, false
+	saveSchedules()
+	o.Info("Schedule %d: Removed", id)
+	return true
+}
+
+type schedulesById []*Schedule
+
+func (sl schedulesById) Len() int {
+	return len(sl)
+}
+
+func (sl schedulesById) Less(i, j int) bool {
+	return sl[i].Id < sl[j].Id
+}
+
+func (sl schedulesById) Swap(i, j int) {
+	sl[i], sl[j] = sl[j], sl[i]
+}
+
+// The schedules who may see - the ones they added, and any they'd be
+// allowed to remove.  Parameters are redacted as they are in the audit
+// log.
+func ListSchedules(who *Identity) (list []*Schedule) {
+	scheduleLock.Lock()
+	all := make([]*Schedule, 0, len(schedules))
+	for _, sched := range schedules {
+		// take a copy, as the scheduler will keep updating them.
+		scopy := new(Schedule)
+		*scopy = *sched
+		all = append(all, scopy)
+	}
+	scheduleLock.Unlock()
+
+	list = make([]*Schedule, 0, len(all))
+	for _, sched := range all {
+		if sched.Submitter != who.String() && !schedulePermitted(who, sched) {
+			continue
+		}
+		rcopy := new(GenericJsonRequest)
+		*rcopy = *sched.Request
+		rcopy.Params = redactParams(sched.Request.Params)
+		sched.Request = rcopy
+		list = append(list, sched)
+	}
+	sort.Sort(schedulesById(list))
+	return list
+}
+
+// queue a job for the schedule.  Returns the job's ID, or 0 if it
+// couldn't be queued.
+func fireSchedule(sched *Schedule) uint64 {
+	job, reason := sched.Request.MakeJob()
+	if nil == job {
+		o.Warn("Schedule %d: Couldn't queue job: %s", sched.Id, reason)
+		return 0
+	}
+	job.Submitter = sched.Submitter
+	QueueJob(job)
+	o.Info("Schedule %d: Queued Job %d", sched.Id, job.Id)
+	return job.Id
+}
+
+// do everything that's due.  Returns when we next need to look (ns).
+func runSchedules() (next int64) {
+	now := time.Nanoseconds()
+	next = now + ScheduleMaxSleep
+
+	var due []uint64
+	var fired []*Schedule
+	scheduleLock.Lock()
+	for id, notBefore := range delayedJobs {
+		if notBefore <= now {
+			due = append(due, id)
+			delayedJobs[id] = 0, false
+		} else if notBefore < next {
+			next = notBefore
+		}
+	}
+	nowSecs := now / 1e9
+	for _, sched := range schedules {
+		if sched.Next != 0 && sched.Next <= nowSecs {
+			fired = append(fired, sched)
+			sched.LastRun = nowSecs
+			sched.Next = sched.spec.Next(nowSecs)
+		}
+		if sched.Next != 0 && sched.Next * 1e9 < next {
+			next = sched.Next * 1e9
+		}
+	}
+	scheduleLock.Unlock()
+
+	for _, id := range due {
+		releaseJob(id)
+	}
+	if len(fired) > 0 {
+		ids := make([]uint64, len(fired))
+		for i, sched := range fired {
+			ids[i] = fireSchedule(sched)
+		}
+		scheduleLock.Lock()
+		for i, sched := range fired {
+			if ids[i] != 0 {
+				sched.LastJob = ids[i]
+			}
+		}
+		saveSchedules()
+		scheduleLock.Unlock()
+	}
+	return next
+}
+
+func scheduleLoop() {
+	for {
+		next := runSchedules()
+		wait := next - time.Nanoseconds()
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-scheduleWake:
+		}
+	}
+}
+
+// Start running schedules.  Must be called after the saved jobs have
+// been restored.
+func StartScheduler() {
+	loadSchedules()
+	go scheduleLoop()
+}
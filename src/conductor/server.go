@@ -11,35 +11,24 @@ import (
 	"fmt"
 	"os"
 	"crypto/x509"
+	"strings"
 	o	"orchestra"
 )
 
 var (
 	CACertPool	*x509.CertPool = nil
+	ServerCert	tls.Certificate
 )
 
-
-func ServiceRequests() {
-	var sockConfig tls.Config
-
-	// resolve the bind address
-	bindAddressStr := GetStringOpt("bind address")
-	var bindAddr *net.IPAddr = nil
-	if (bindAddressStr != "") {
-		var err os.Error
-		bindAddr, err = net.ResolveIPAddr("ip", bindAddressStr)
-		if (err != nil) {
-			o.Warn("Ignoring bind address.  Couldn't resolve \"%s\": %s", bindAddressStr, err)
-		} else {
-			bindAddr = nil
-		}
-	}
-	// load the x509 certificate and key, then attach it to the tls config.
+// Load our own certificate, and the CAs we trust to sign our clients'
+// certificates.  This must happen before any TLS listeners are started.
+func LoadCertificates() {
+	// load the x509 certificate and key
 	x509CertFilename := GetStringOpt("x509 certificate")
 	x509PrivateKeyFilename := GetStringOpt("x509 private key")
-	serverCert, err := tls.LoadX509KeyPair(x509CertFilename, x509PrivateKeyFilename)
+	var err os.Error
+	ServerCert, err = tls.LoadX509KeyPair(x509CertFilename, x509PrivateKeyFilename)
 	o.MightFail(err, "Couldn't load certificates")
-	sockConfig.Certificates = append(sockConfig.Certificates, serverCert)
 
 	// load the CA certs
 	CACertPool = x509.NewCertPool()
@@ -59,6 +48,79 @@ func ServiceRequests() {
 			CACertPool.AppendCertsFromPEM(data)
 		}
 	}
+}
+
+// Check that the peer on a TLS connection presented a certificate that
+// chains back to one of our CAs.  If dnsName is set, the certificate
+// must also be for that name.  Returns the peer's certificate.
+func verifyPeerCertificate(tlsc *tls.Conn, dnsName string) (cert *x509.Certificate, err os.Error) {
+	intermediates := x509.NewCertPool()
+
+	o.Debug("Checking Connection State")
+	cs := tlsc.ConnectionState()
+	vo := x509.VerifyOptions{
+	Roots: CACertPool,
+	Intermediates: intermediates,
+	DNSName: dnsName,
+	}
+	if cs.PeerCertificates == nil || cs.PeerCertificates[0] == nil {
+		return nil, os.NewError("Peer didn't provide a certificate")
+	}
+	// load any intermediate certificates from the chain
+	// into the intermediates pool so we can verify that
+	// the chain can be rebuilt.
+	//
+	// All we care is that we can reach an authorised CA.
+	//
+	//FIXME: Need CRL handling.
+	if len(cs.PeerCertificates) > 1 {
+		for i := 1; i < len(cs.PeerCertificates); i++ {
+			intermediates.AddCert(cs.PeerCertificates[i])
+		}
+	}
+	_, err = cs.PeerCertificates[0].Verify(vo)
+	if err != nil {
+		return nil, err
+	}
+	return cs.PeerCertificates[0], nil
+}
+
+// Render a certificate's subject in the familiar /C=../CN=.. form.
+func subjectString(cert *x509.Certificate) string {
+	var parts []string
+	add := func(key string, values []string) {
+		for _, v := range values {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	add("C", cert.Subject.Country)
+	add("ST", cert.Subject.Province)
+	add("L", cert.Subject.Locality)
+	add("O", cert.Subject.Organization)
+	add("OU", cert.Subject.OrganizationalUnit)
+	if cert.Subject.CommonName != "" {
+		add("CN", []string{cert.Subject.CommonName})
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func ServiceRequests() {
+	var sockConfig tls.Config
+
+	// resolve the bind address
+	bindAddressStr := GetStringOpt("bind address")
+	var bindAddr *net.IPAddr = nil
+	if (bindAddressStr != "") {
+		var err os.Error
+		bindAddr, err = net.ResolveIPAddr("ip", bindAddressStr)
+		if (err != nil) {
+			o.Warn("Ignoring bind address.  Couldn't resolve \"%s\": %s", bindAddressStr, err)
+		} else {
+			bindAddr = nil
+		}
+	}
+	// attach our certificates to the tls config.
+	sockConfig.Certificates = append(sockConfig.Certificates, ServerCert)
 	sockConfig.RootCAs = CACertPool
 
 	// determine the server hostname.
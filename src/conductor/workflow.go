@@ -0,0 +1,524 @@
+/* workflow.go
+ *
+ * Multi-step workflows.
+ *
+ * A workflow is a named set of steps, each of which runs a score.  A
+ * step may wait for other steps ('After'), in which case it's only
+ * started once they've all succeeded - if any of them doesn't, the step
+ * is skipped.  Step parameters may refer to the run's parameters as
+ * '{{params.key}}', or to the response of an earlier step as
+ * '{{step.key}}'.
+ *
+ * Workflows are defined in a JSON file:
+ *
+ *	{
+ *	  "deploy": {
+ *	    "Steps": {
+ *	      "build": {"Score": "build", "Players": ["@builders"],
+ *	                "Scope": "one", "Params": {"rev": "{{params.rev}}"}},
+ *	      "push":  {"Score": "deploy", "Players": ["@web"],
+ *	                "Scope": "all", "After": ["build"],
+ *	                "Params": {"artifact": "{{build.artifact}}"}}
+ *	    }
+ *	  }
+ *	}
+ *
+ * Each step becomes an ordinary job when it's started, so all the
+ * usual job tooling works on them.
+*/
+
+package main
+
+import (
+	"json"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"io/ioutil"
+	o "orchestra"
+)
+
+type WorkflowStep struct {
+	Score		string
+	Players		[]string
+	Scope		string
+	Params		map[string]string
+	Priority	*int
+	RunTimeout	*int
+	After		[]string
+}
+
+type Workflow struct {
+	Steps		map[string]*WorkflowStep
+}
+
+// Step states, beyond the usual job states.
+const (
+	StepWaiting	= "WAITING"
+	StepSkipped	= "SKIPPED"
+	StepInvalid	= "INVALID"
+)
+
+type StepRun struct {
+	// the job running the step, once it's been started.
+	Job		uint64
+	Status		string
+	// why the step was skipped or couldn't be started.
+	Reason		string
+}
+
+type WorkflowRun struct {
+	Id		uint64
+	Workflow	string
+	Params		map[string]string
+	Submitter	string
+	// seconds since the epoch.
+	Created		int64
+	Finished	int64
+	Status		string
+	Steps		map[string]*StepRun
+	// a copy of the definition, in case it changes under us.
+	Definition	*Workflow
+}
+
+type stepRef struct {
+	run		*WorkflowRun
+	step		string
+}
+
+var (
+	workflows	= make(map[string]*Workflow)
+	runs		= make(map[uint64]*WorkflowRun)
+	lastRunId	uint64 = 0
+	// which step of which run each job belongs to.
+	stepJobs	= make(map[uint64]*stepRef)
+	workflowLock	sync.Mutex
+)
+
+var paramRefRegexp = regexp.MustCompile("{{[^}]+}}")
+
+func workflowRunPath() string {
+	return path.Join(GetStringOpt("conductor state path"), "workflow_runs.json")
+}
+
+// Check the workflow makes sense - every step has a score, and the
+// steps it waits for exist and don't loop back on themselves.
+func (wf *Workflow) validate() os.Error {
+	if len(wf.Steps) == 0 {
+		return os.NewError("no steps")
+	}
+	for name, step := range wf.Steps {
+		if step.Score == "" || step.Scope == "" || len(step.Players) == 0 {
+			return os.NewError("step \"" + name + "\" needs a Score, Scope and Players")
+		}
+		if name == "params" {
+			return os.NewError("\"params\" is reserved")
+		}
+		for _, after := range step.After {
+			if _, exists := wf.Steps[after]; !exists {
+				return os.NewError("step \"" + name + "\" waits for unknown step \"" + after + "\"")
+			}
+		}
+	}
+	// 0 = unvisited, 1 = in progress, 2 = done.
+	visited := make(map[string]int)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch visited[name] {
+		case 1:
+			return false
+		case 2:
+			return true
+		}
+		visited[name] = 1
+		for _, after := range wf.Steps[name].After {
+			if !visit(after) {
+				return false
+			}
+		}
+		visited[name] = 2
+		return true
+	}
+	for name, _ := range wf.Steps {
+		if !visit(name) {
+			return os.NewError("steps loop back on themselves")
+		}
+	}
+	return nil
+}
+
+func LoadWorkflows(filename string) (wfs map[string]*Workflow, err os.Error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	wfs = make(map[string]*Workflow)
+	err = json.Unmarshal(data, &wfs)
+	if err != nil {
+		return nil, err
+	}
+	for name, wf := range wfs {
+		err = wf.validate()
+		if err != nil {
+			return nil, os.NewError("workflow \"" + name + "\": " + err.String())
+		}
+	}
+	return wfs, nil
+}
+
+func SetWorkflows(wfs map[string]*Workflow) {
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	workflows = wfs
+}
+
+// Write out all the runs.  Must be called with workflowLock held.
+func saveRuns() {
+	list := make([]*WorkflowRun, 0, len(runs))
+	for _, run := range runs {
+		list = append(list, run)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		o.Warn("Couldn't encode workflow runs: %s", err)
+		return
+	}
+	err = os.MkdirAll(GetStringOpt("conductor state path"), 0700)
+	if err != nil {
+		o.Warn("Couldn't create conductor state directory: %s", err)
+		return
+	}
+	fname := workflowRunPath()
+	tmpname := fname + ".tmp"
+	err = ioutil.WriteFile(tmpname, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpname, fname)
+	}
+	if err != nil {
+		o.Warn("Couldn't save workflow runs: %s", err)
+		os.Remove(tmpname)
+	}
+}
+
+func loadRuns() {
+	data, err := ioutil.ReadFile(workflowRunPath())
+	if err != nil {
+		pe, ok := err.(*os.PathError)
+		if !ok || pe.Error != os.ENOENT {
+			o.Warn("Couldn't read workflow runs: %s", err)
+		}
+		return
+	}
+	var list []*WorkflowRun
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		o.Warn("Couldn't decode workflow runs: %s", err)
+		return
+	}
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+	for _, run := range list {
+		runs[run.Id] = run
+		if run.Id > lastRunId {
+			lastRunId = run.Id
+		}
+		for name, sr := range run.Steps {
+			if sr.Job != 0 {
+				stepJobs[sr.Job] = &stepRef{run, name}
+			}
+		}
+		// catch up on anything that finished whilst we were away.
+		if run.Status == jobStateName(o.JOB_PENDING) {
+			refreshRun(run)
+			advanceRun(run)
+		}
+	}
+	saveRuns()
+}
+
+// look up a parameter reference for a step.
+func (run *WorkflowRun) resolve(ref string) (value string, ok bool) {
+	parts := strings.SplitN(ref, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	if parts[0] == "params" {
+		value, ok = run.Params[parts[1]]
+		return value, ok
+	}
+	sr, exists := run.Steps[parts[0]]
+	if !exists || sr.Job == 0 {
+		return "", false
+	}
+	// take the value from the first player (by name) that
+	// succeeded and gave us one.
+	names := o.JobGetResultNames(sr.Job)
+	sort.Strings(names)
+	for _, name := range names {
+		tr := o.JobGetResult(sr.Job, name)
+		if nil != tr && tr.State == o.RESP_FINISHED {
+			value, ok = tr.Response[parts[1]]
+			if ok {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// build the queue request for a step, filling in the parameters.  If
+// any of them can't be resolved yet, reason says which.
+func (run *WorkflowRun) stepRequest(name string) (req *GenericJsonRequest, reason string) {
+	step := run.Definition.Steps[name]
+	req = new(GenericJsonRequest)
+	score := step.Score
+	req.Score = &score
+	scope := step.Scope
+	req.Scope = &scope
+	req.Players = step.Players
+	req.Priority = step.Priority
+	req.RunTimeout = step.RunTimeout
+	req.Params = make(map[string]string)
+	for k, v := range step.Params {
+		req.Params[k] = paramRefRegexp.ReplaceAllStringFunc(v, func(m string) string {
+			ref := strings.TrimSpace(m[2:len(m)-2])
+			value, ok := run.resolve(ref)
+			if !ok {
+				reason = "Unresolved Parameter " + ref
+			}
+			return value
+		})
+	}
+	return req, reason
+}
+
+// pull in the state of any jobs that have finished.  Must be called
+// with workflowLock held.
+func refreshRun(run *WorkflowRun) {
+	for _, sr := range run.Steps {
+		if sr.Job == 0 || sr.Status != jobStateName(o.JOB_PENDING) {
+			continue
+		}
+		job := o.JobGet(sr.Job)
+		if nil == job {
+			sr.Status = jobStateName(o.JOB_FAILED)
+			sr.Reason = "Expired"
+		} else if job.IsTerminal() {
+			sr.Status = jobStateName(job.State)
+		}
+	}
+}
+
+// start anything that's ready, and skip anything that can't run.  Must
+// be called with workflowLock held.
+func advanceRun(run *WorkflowRun) {
+	okName := jobStateName(o.JOB_SUCCESSFUL)
+	pendingName := jobStateName(o.JOB_PENDING)
+	for changed := true; changed; {
+		changed = false
+		for name, sr := range run.Steps {
+			if sr.Status != StepWaiting {
+				continue
+			}
+			ready := true
+			skip := ""
+			for _, after := range run.Definition.Steps[name].After {
+				switch run.Steps[after].Status {
+				case okName:
+				case StepWaiting:
+					fallthrough
+				case pendingName:
+					ready = false
+				default:
+					skip = after
+				}
+			}
+			if skip != "" {
+				sr.Status = StepSkipped
+				sr.Reason = "Step " + skip + " didn't succeed"
+				changed = true
+				continue
+			}
+			if !ready {
+				continue
+			}
+			changed = true
+			req, reason := run.stepRequest(name)
+			var job *o.JobRequest = nil
+			if reason == "" {
+				job, reason = req.MakeJob()
+			}
+			if nil == job {
+				o.Warn("Workflow run %d: Couldn't start step %s: %s", run.Id, name, reason)
+				sr.Status = StepInvalid
+				sr.Reason = reason
+				continue
+			}
+			job.Submitter = run.Submitter
+			QueueJob(job)
+			sr.Job = job.Id
+			sr.Status = pendingName
+			stepJobs[job.Id] = &stepRef{run, name}
+			o.Info("Workflow run %d: Step %s is Job %d", run.Id, name, job.Id)
+		}
+	}
+	// is the run over?
+	failed := false
+	for _, sr := range run.Steps {
+		switch sr.Status {
+		case StepWaiting:
+			fallthrough
+		case pendingName:
+			return
+		case okName:
+		default:
+			failed = true
+		}
+	}
+	if failed {
+		run.Status = jobStateName(o.JOB_FAILED)
+	} else {
+		run.Status = okName
+	}
+	run.Finished = time.Seconds()
+	o.Info("Workflow run %d: Finished (%s)", run.Id, run.Status)
+}
+
+// Start a run of the named workflow.  Every step is checked against the
+// policy up front.
+func StartWorkflow(name string, params map[string]string, who *Identity) (id uint64, reason string) {
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	wf, exists := workflows[name]
+	if !exists {
+		return 0, "Unknown Workflow"
+	}
+	run := new(WorkflowRun)
+	run.Workflow = name
+	run.Params = params
+	if run.Params == nil {
+		run.Params = make(map[string]string)
+	}
+	run.Submitter = who.String()
+	run.Created = time.Seconds()
+	run.Status = jobStateName(o.JOB_PENDING)
+	run.Definition = wf
+	run.Steps = make(map[string]*StepRun)
+	for stepName, _ := range wf.Steps {
+		// parameters from earlier steps aren't known yet, but
+		// they don't change what the step is allowed to do.
+		req, _ := run.stepRequest(stepName)
+		job, reason := req.MakeJob()
+		if nil == job {
+			return 0, reason
+		}
+		if !JobPermitted(who, job) {
+			return 0, "Forbidden"
+		}
+		sr := new(StepRun)
+		sr.Status = StepWaiting
+		run.Steps[stepName] = sr
+	}
+	lastRunId++
+	run.Id = lastRunId
+	runs[run.Id] = run
+	o.Info("Workflow run %d: Starting %s for %s", run.Id, name, run.Submitter)
+	advanceRun(run)
+	saveRuns()
+
+	return run.Id, ""
+}
+
+// Get a snapshot of a run.
+func GetWorkflowRun(id uint64) *WorkflowRun {
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	run, exists := runs[id]
+	if !exists {
+		return nil
+	}
+	rcopy := new(WorkflowRun)
+	*rcopy = *run
+	rcopy.Steps = make(map[string]*StepRun)
+	for name, sr := range run.Steps {
+		srcopy := new(StepRun)
+		*srcopy = *sr
+		rcopy.Steps[name] = srcopy
+	}
+	return rcopy
+}
+
+// May who see the run?  Its submitter can, and so can anyone the policy
+// would let touch every one of its steps.
+func WorkflowRunPermitted(who *Identity, run *WorkflowRun) bool {
+	if nil == GetPolicy() {
+		return true
+	}
+	if run.Submitter != "" && run.Submitter == who.String() {
+		return true
+	}
+	for stepName, _ := range run.Definition.Steps {
+		req, _ := run.stepRequest(stepName)
+		job, _ := req.MakeJob()
+		if nil == job || !JobPermitted(who, job) {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget about finished runs that are older than maxAge (in ns).
+func ExpireWorkflowRuns(maxAge int64) {
+	if maxAge <= 0 {
+		return
+	}
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	cutoff := (time.Nanoseconds() - maxAge) / 1e9
+	expired := 0
+	for id, run := range runs {
+		if run.Finished != 0 && run.Finished < cutoff {
+			for _, sr := range run.Steps {
+				stepJobs[sr.Job] = nil, false
+			}
+			runs[id] = nil, false
+			expired++
+		}
+	}
+	if expired > 0 {
+		o.Info("Expired %d workflow runs", expired)
+		saveRuns()
+	}
+}
+
+func workflowLoop(sub *o.JobSubscription) {
+	for ev := range sub.Events {
+		if ev.Player != "" || !o.IsTerminalState(ev.State) {
+			continue
+		}
+		workflowLock.Lock()
+		ref, exists := stepJobs[ev.Id]
+		if exists && ref.run.Steps[ref.step].Status == jobStateName(o.JOB_PENDING) {
+			sr := ref.run.Steps[ref.step]
+			sr.Status = jobStateName(ev.State)
+			advanceRun(ref.run)
+			saveRuns()
+		}
+		workflowLock.Unlock()
+	}
+}
+
+// Must be called after the saved jobs have been restored.
+func StartWorkflows() {
+	sub, _ := o.JobSubscribe(0)
+	loadRuns()
+	go workflowLoop(sub)
+}
@@ -11,17 +11,22 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type StatusRequest struct {
 	Op	string
 	Id	uint64
+	Timeout	int64
 }
 
 type PlayerStatus struct {
 	Status		*string
 	Response	map[string]*string
+	Stdout		*string
+	Stderr		*string
 }
 
 type StatusResponse struct {
@@ -30,7 +35,10 @@ type StatusResponse struct {
 }
 
 var (
+	Wait         = flag.Bool("wait", false, "Wait for the job to finish before reporting its status")
+	WaitTimeout  = flag.Int64("timeout", 0, "Maximum number of seconds to wait (0 waits forever)")
 	AudienceSock = flag.String("audience-sock", "/var/run/conductor.sock", "Path for the audience submission socket")
+	ShowOutput   = flag.Bool("output", false, "Show each player's status and the end of its score's output")
 )
 
 func NewStatusRequest() (sr *StatusRequest) {
@@ -45,6 +53,36 @@ func Usage() {
 	flag.PrintDefaults()
 }
 
+func printOutput(name string, output *string) {
+	if nil == output || *output == "" {
+		return
+	}
+	fmt.Printf("  --- %s ---\n", name)
+	text := *output
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	fmt.Print(text)
+}
+
+func printPlayers(players map[string]*PlayerStatus) {
+	names := make([]string, 0, len(players))
+	for name, _ := range players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ps := players[name]
+		status := "UNKNOWN"
+		if nil != ps.Status {
+			status = *ps.Status
+		}
+		fmt.Printf("%s: %s\n", name, status)
+		printOutput("stdout", ps.Stdout)
+		printOutput("stderr", ps.Stderr)
+	}
+}
+
 func main() {
 	flag.Usage = Usage
 	flag.Parse()
@@ -55,6 +93,10 @@ func main() {
 	}
 
 	sr := NewStatusRequest()
+	if *Wait {
+		sr.Op = "wait"
+		sr.Timeout = *WaitTimeout
+	}
 	var err os.Error
 	sr.Id, err = strconv.Atoui64(flag.Arg(0))
 	if nil != err {
@@ -125,9 +167,17 @@ func main() {
 		if rerr == "OK" {
 			// all OK, process the sresp.
 			fmt.Printf("Aggregate: %s\n", *sresp.Status)
+			if *ShowOutput {
+				printPlayers(sresp.Players)
+			}
 			os.Exit(0)
 		} else {
-			fmt.Fprintf(os.Stderr, "Server Error: %s\n", rerr)
+			reason, ok := response[1].(string)
+			if ok {
+				fmt.Fprintf(os.Stderr, "Server Error: %s: %s\n", rerr, reason)
+			} else {
+				fmt.Fprintf(os.Stderr, "Server Error: %s\n", rerr)
+			}
 			os.Exit(1)
 		}
 	} else {
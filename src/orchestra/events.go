@@ -0,0 +1,91 @@
+// events.go
+//
+// Job change notification.
+//
+// The registry publishes a JobEvent whenever a job picks up a new
+// result or changes state.  Interested parties subscribe to a single
+// job (or to every job) and receive the events in order.
+//
+// Since the registry thread must never block, each subscription has
+// its own relay goroutine which queues events until the subscriber is
+// ready for them.
+
+package orchestra
+
+import (
+	"container/list"
+)
+
+const (
+	subscriptionQueueSize	= 10
+)
+
+type JobEvent struct {
+	Id		uint64
+	// the player whose task changed, or "" if this is a change to
+	// the job's aggregate state.
+	Player		string
+	// the new JOB_ state (for job changes) or RESP_ state (for task
+	// changes).
+	State		int
+	// the previous JOB_ state.  Only set for job changes.
+	OldState	int
+	// the task's result.  Only set for task changes.
+	Result		*TaskResponse
+}
+
+type JobSubscription struct {
+	// the job we're watching, or 0 for all jobs.
+	Id		uint64
+	// Events are delivered here.  The channel is closed once the
+	// subscription has been cancelled.
+	Events		<-chan *JobEvent
+	in		chan *JobEvent
+	out		chan *JobEvent
+}
+
+func newJobSubscription(id uint64) (sub *JobSubscription) {
+	sub = new(JobSubscription)
+	sub.Id = id
+	sub.in = make(chan *JobEvent, subscriptionQueueSize)
+	sub.out = make(chan *JobEvent)
+	sub.Events = sub.out
+
+	go sub.relay()
+
+	return sub
+}
+
+// shuffle events from the registry to the subscriber, queueing as
+// many as we have to.
+func (sub *JobSubscription) relay() {
+	pending := list.New()
+	for {
+		var out chan<- *JobEvent = nil
+		var next *JobEvent = nil
+		if pending.Len() > 0 {
+			out = sub.out
+			next, _ = pending.Front().Value.(*JobEvent)
+		}
+		select {
+		case ev, ok := <-sub.in:
+			if !ok {
+				close(sub.out)
+				return
+			}
+			pending.PushBack(ev)
+		case out <- next:
+			pending.Remove(pending.Front())
+		}
+	}
+}
+
+// Only to be called from the registry thread.
+func (sub *JobSubscription) publish(ev *JobEvent) {
+	sub.in <- ev
+}
+
+// Only to be called from the registry thread.
+func (sub *JobSubscription) cancel() {
+	close(sub.in)
+}
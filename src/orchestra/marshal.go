@@ -57,6 +57,13 @@ func (p *WirePkt) Decode() (obj interface{}, err os.Error) {
 			return nil, err
 		}
 		return tr, nil
+	case TypeCancelTask:
+		ct := new(ProtoCancelTask)
+		err := proto.Unmarshal(p.Payload[0:p.Length], ct)
+		if err != nil {
+			return nil, err
+		}
+		return ct, nil
 	}
 	return nil, ErrUnknownMessage
 }
@@ -72,6 +79,8 @@ func Encode(obj interface{}) (p *WirePkt, err os.Error) {
 		p.Type = TypeTaskResponse
 	case *ProtoAcknowledgement:
 		p.Type = TypeAcknowledgement
+	case *ProtoCancelTask:
+		p.Type = TypeCancelTask
 	default:
 		Warn("Encoding unknown type!")
 		return nil, ErrUnknownType
@@ -139,3 +148,13 @@ func MakeAck(id uint64) (p *WirePkt) {
 
 	return p
 }
+
+// Construct a request to cancel a task
+func MakeCancelTask(id uint64) (p *WirePkt) {
+	ct := new(ProtoCancelTask)
+	ct.Id = proto.Uint64(id)
+
+	p, _ = Encode(ct)
+
+	return p
+}
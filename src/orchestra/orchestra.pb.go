@@ -46,6 +46,9 @@ const (
 	ProtoTaskResponse_JOB_HOST_FAILURE	= 5
 	ProtoTaskResponse_JOB_UNKNOWN		= 6
 	ProtoTaskResponse_JOB_UNKNOWN_FAILURE	= 7
+	ProtoTaskResponse_JOB_CANCELLED		= 8
+	ProtoTaskResponse_JOB_TIMED_OUT		= 9
+	ProtoTaskResponse_JOB_INVALID_PARAMS	= 10
 )
 
 var ProtoTaskResponse_TaskStatus_name = map[int32]string{
@@ -55,6 +58,9 @@ var ProtoTaskResponse_TaskStatus_name = map[int32]string{
 	5:	"JOB_HOST_FAILURE",
 	6:	"JOB_UNKNOWN",
 	7:	"JOB_UNKNOWN_FAILURE",
+	8:	"JOB_CANCELLED",
+	9:	"JOB_TIMED_OUT",
+	10:	"JOB_INVALID_PARAMS",
 }
 var ProtoTaskResponse_TaskStatus_value = map[string]int32{
 	"JOB_INPROGRESS":	2,
@@ -63,6 +69,9 @@ var ProtoTaskResponse_TaskStatus_value = map[string]int32{
 	"JOB_HOST_FAILURE":	5,
 	"JOB_UNKNOWN":		6,
 	"JOB_UNKNOWN_FAILURE":	7,
+	"JOB_CANCELLED":	8,
+	"JOB_TIMED_OUT":	9,
+	"JOB_INVALID_PARAMS":	10,
 }
 
 func NewProtoTaskResponse_TaskStatus(x int32) *ProtoTaskResponse_TaskStatus {
@@ -94,6 +103,7 @@ type ProtoTaskRequest struct {
 	Jobname			*string			`protobuf:"bytes,1,req,name=jobname"`
 	Id			*uint64			`protobuf:"varint,2,req,name=id"`
 	Parameters		[]*ProtoJobParameter	`protobuf:"bytes,3,rep,name=parameters"`
+	Timeout			*uint32			`protobuf:"varint,4,opt,name=timeout"`
 	XXX_unrecognized	[]byte
 }
 
@@ -115,12 +125,22 @@ type ProtoTaskResponse struct {
 	Id			*uint64				`protobuf:"varint,1,req,name=id"`
 	Status			*ProtoTaskResponse_TaskStatus	`protobuf:"varint,3,req,name=status,enum=orchestra.ProtoTaskResponse_TaskStatus"`
 	Response		[]*ProtoJobParameter		`protobuf:"bytes,4,rep,name=response"`
+	Stdout			*string				`protobuf:"bytes,5,opt,name=stdout"`
+	Stderr			*string				`protobuf:"bytes,6,opt,name=stderr"`
 	XXX_unrecognized	[]byte
 }
 
 func (this *ProtoTaskResponse) Reset()		{ *this = ProtoTaskResponse{} }
 func (this *ProtoTaskResponse) String() string	{ return proto.CompactTextString(this) }
 
+type ProtoCancelTask struct {
+	Id			*uint64	`protobuf:"varint,1,req,name=id"`
+	XXX_unrecognized	[]byte
+}
+
+func (this *ProtoCancelTask) Reset()		{ *this = ProtoCancelTask{} }
+func (this *ProtoCancelTask) String() string	{ return proto.CompactTextString(this) }
+
 func init() {
 	proto.RegisterEnum("orchestra.ProtoAcknowledgement_AckType", ProtoAcknowledgement_AckType_name, ProtoAcknowledgement_AckType_value)
 	proto.RegisterEnum("orchestra.ProtoTaskResponse_TaskStatus", ProtoTaskResponse_TaskStatus_name, ProtoTaskResponse_TaskStatus_value)
@@ -0,0 +1,136 @@
+/* persist.go
+ *
+ * Serialisable job records.
+ *
+ * JobRequests can't be written out directly - the tasks point back at
+ * their job, and the results are private to the registry - so we
+ * flatten them into a JobRecord first.
+*/
+
+package orchestra
+
+type TaskRecord struct {
+	Player		string
+	State		int
+}
+
+type JobRecord struct {
+	Score		string
+	Scope		int
+	Players		[]string
+	Requested	[]string
+	Targets		[]string
+	Id		uint64
+	State		int
+	Quorum		int
+	Batch		int
+	FailureBudget	int
+	Priority	int
+	NotBefore	int64
+	DependsOn	[]uint64
+	Condition	int
+	DependencyFailed	bool
+	Timeout		int
+	Params		map[string]string
+	Created		int64
+	Finished	int64
+	Cancelled	bool
+	Submitter	string
+	Tasks		[]*TaskRecord
+	Results		map[string]*TaskResponse
+}
+
+// build a record from the job.  Must only be called from the registry
+// thread as it reads the results.
+func (job *JobRequest) record() (rec *JobRecord) {
+	rec = new(JobRecord)
+	rec.Score = job.Score
+	rec.Scope = job.Scope
+	rec.Players = make([]string, len(job.Players))
+	copy(rec.Players, job.Players)
+	rec.Requested = make([]string, len(job.Requested))
+	copy(rec.Requested, job.Requested)
+	rec.Targets = make([]string, len(job.Targets))
+	copy(rec.Targets, job.Targets)
+	rec.Id = job.Id
+	rec.State = job.State
+	rec.Quorum = job.Quorum
+	rec.Batch = job.Batch
+	rec.FailureBudget = job.FailureBudget
+	rec.Priority = job.Priority
+	rec.NotBefore = job.NotBefore
+	rec.DependsOn = job.DependsOn
+	rec.Condition = job.Condition
+	rec.DependencyFailed = job.DependencyFailed
+	rec.Timeout = job.Timeout
+	rec.Params = make(map[string]string)
+	for k, v := range job.Params {
+		rec.Params[k] = v
+	}
+	rec.Created = job.Created
+	rec.Finished = job.Finished
+	rec.Cancelled = job.Cancelled
+	rec.Submitter = job.Submitter
+	rec.Tasks = make([]*TaskRecord, len(job.Tasks))
+	for i, task := range job.Tasks {
+		rec.Tasks[i] = new(TaskRecord)
+		rec.Tasks[i].Player = task.Player
+		rec.Tasks[i].State = task.State
+	}
+	rec.Results = make(map[string]*TaskResponse)
+	for k, v := range job.results {
+		rec.Results[k] = v
+	}
+
+	return rec
+}
+
+// Reconstruct a job (with tasks and results) from a record.  The job
+// still needs to be added to the registry.
+func JobFromRecord(rec *JobRecord) (job *JobRequest) {
+	job = NewJobRequest()
+	job.Score = rec.Score
+	job.Scope = rec.Scope
+	job.Players = rec.Players
+	job.Requested = rec.Requested
+	job.Targets = rec.Targets
+	if len(job.Targets) == 0 {
+		// saved before we kept track of them.
+		job.Targets = rec.Players
+	}
+	job.Id = rec.Id
+	job.State = rec.State
+	job.Quorum = rec.Quorum
+	job.Batch = rec.Batch
+	job.FailureBudget = rec.FailureBudget
+	job.Priority = rec.Priority
+	job.NotBefore = rec.NotBefore
+	job.DependsOn = rec.DependsOn
+	job.Condition = rec.Condition
+	job.DependencyFailed = rec.DependencyFailed
+	job.Timeout = rec.Timeout
+	job.Params = rec.Params
+	if job.Params == nil {
+		job.Params = make(map[string]string)
+	}
+	job.Created = rec.Created
+	job.Finished = rec.Finished
+	job.Cancelled = rec.Cancelled
+	job.Submitter = rec.Submitter
+	job.Tasks = make([]*TaskRequest, len(rec.Tasks))
+	for i, trec := range rec.Tasks {
+		task := new(TaskRequest)
+		task.Job = job
+		task.Player = trec.Player
+		task.State = trec.State
+		job.Tasks[i] = task
+	}
+	for k, v := range rec.Results {
+		if v.Response == nil {
+			v.Response = make(map[string]string)
+		}
+		job.results[k] = v
+	}
+
+	return job
+}
@@ -16,6 +16,7 @@ package orchestra
 
 import (
 	"sort"
+	"time"
 )
 
 const (
@@ -26,6 +27,16 @@ const (
 	requestGetJobResultNames
 	requestDisqualifyPlayer
 	requestReviewJobStatus
+	requestGetJobRecord
+	requestMarkJobFinished
+	requestExpireJobs
+	requestIsJobExpired
+	requestSetExpiredMark
+	requestCancelJob
+	requestListJobs
+	requestSubscribe
+	requestUnsubscribe
+	requestFailDependency
 
 	requestQueueSize		= 10
 )
@@ -37,6 +48,10 @@ type registryRequest struct {
 	player			string
 	job			*JobRequest
 	tresp			*TaskResponse
+	maxAge			int64
+	maxCount		int
+	filter			*JobFilter
+	sub			*JobSubscription
 	responseChannel		chan *registryResponse
 }
 
@@ -45,6 +60,28 @@ type registryResponse struct {
 	tresp			*TaskResponse
 	names			[]string
 	jobs			[]*JobRequest
+	record			*JobRecord
+	ids			[]uint64
+	more			bool
+	sub			*JobSubscription
+}
+
+// JobFilter describes which jobs JobList should return.  Unset (zero)
+// fields match everything.
+type JobFilter struct {
+	// only jobs in one of these states.
+	States		[]int
+	// only jobs for this score.
+	Score		string
+	// only jobs that targetted this player.
+	Player		string
+	// only jobs registered in this window (ns).
+	CreatedAfter	int64
+	CreatedBefore	int64
+	// Paging.  Jobs are returned newest (highest ID) first, starting
+	// after the Cursor ID, with at most Limit jobs per page.
+	Cursor		uint64
+	Limit		int
 }
 	
 var chanRequest = make(chan *registryRequest, requestQueueSize)
@@ -148,28 +185,244 @@ func JobReviewState(id uint64) bool {
 	return resp.success
 }
 
+// Get a serialisable snapshot of a job, its tasks and its results.
+// Returns nil if the job couldn't be found.
+func JobGetRecord(id uint64) *JobRecord {
+	rr := newRequest(true)
+	rr.operation = requestGetJobRecord
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.record
+}
+
+// Mark a job as finished as of now.  The conductor works this out
+// for itself from the results, but the player has to tell us once the
+// conductor has acknowledged our response.
+func JobMarkFinished(id uint64) bool {
+	rr := newRequest(true)
+	rr.operation = requestMarkJobFinished
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.success
+}
+
+// Evict finished jobs from the registry.  Jobs that finished more than
+// maxAge ns ago are removed, and then the oldest finished jobs are
+// removed until no more than maxCount remain.  A zero limit is
+// ignored.  Returns the IDs of the jobs that were evicted.
+func JobExpire(maxAge int64, maxCount int) (ids []uint64) {
+	rr := newRequest(true)
+	rr.operation = requestExpireJobs
+	rr.maxAge = maxAge
+	rr.maxCount = maxCount
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.ids
+}
+
+// true if the job isn't in the registry because it has been evicted.
+func JobExpired(id uint64) bool {
+	rr := newRequest(true)
+	rr.operation = requestIsJobExpired
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.success
+}
+
+// Tell the registry that all jobs up to and including id that it
+// doesn't know about have been evicted.  Used to restore the expiry
+// state after a restart.
+func JobSetExpiredMark(id uint64) {
+	rr := newRequest(true)
+	rr.operation = requestSetExpiredMark
+	rr.id = id
+
+	chanRequest <- rr
+	<- rr.responseChannel
+}
+
+// Mark a job as cancelled.  Returns false if the job doesn't exist or
+// has already finished.
+func JobCancel(id uint64) bool {
+	rr := newRequest(true)
+	rr.operation = requestCancelJob
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.success
+}
+
+// Fail a job because its dependencies can't be satisfied.  Returns
+// false if the job doesn't exist or has already finished.  The caller
+// must have finished off the job's tasks first.
+func JobFailDependency(id uint64) bool {
+	rr := newRequest(true)
+	rr.operation = requestFailDependency
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.success
+}
+
+// Find the jobs matching filter.  more is true if there are further
+// matches beyond the last job returned - use its ID as the next cursor.
+func JobList(filter *JobFilter) (jobs []*JobRequest, more bool) {
+	rr := newRequest(true)
+	rr.operation = requestListJobs
+	rr.filter = filter
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.jobs, resp.more
+}
+
+func (job *JobRequest) matches(filter *JobFilter) bool {
+	if filter.Cursor != 0 && job.Id >= filter.Cursor {
+		return false
+	}
+	if filter.Score != "" && job.Score != filter.Score {
+		return false
+	}
+	if filter.CreatedAfter != 0 && job.Created < filter.CreatedAfter {
+		return false
+	}
+	if filter.CreatedBefore != 0 && job.Created >= filter.CreatedBefore {
+		return false
+	}
+	if len(filter.States) > 0 {
+		found := false
+		for _, state := range filter.States {
+			if job.State == state {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Player != "" {
+		// the player might have been disqualified, but still
+		// have left a result behind.
+		_, exists := job.results[filter.Player]
+		if !exists {
+			idx := sort.SearchStrings(job.Players, filter.Player)
+			if idx >= len(job.Players) || job.Players[idx] != filter.Player {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Subscribe to changes to a job, or to all jobs if id is 0.  Returns
+// the subscription and a snapshot of the job as it was when the
+// subscription started (nil if watching all jobs).  Returns a nil
+// subscription if the job doesn't exist.
+//
+// Subscribers must keep reading Events until they unsubscribe.
+func JobSubscribe(id uint64) (sub *JobSubscription, rec *JobRecord) {
+	rr := newRequest(true)
+	rr.operation = requestSubscribe
+	rr.id = id
+
+	chanRequest <- rr
+	resp := <- rr.responseChannel
+
+	return resp.sub, resp.record
+}
+
+// Stop receiving events for a subscription.  The Events channel will
+// be closed once any queued events have been discarded.
+func JobUnsubscribe(sub *JobSubscription) {
+	rr := newRequest(true)
+	rr.operation = requestUnsubscribe
+	rr.sub = sub
+
+	chanRequest <- rr
+	<- rr.responseChannel
+}
+
+// sorts jobs newest first.
+type jobsByIdDesc []*JobRequest
+
+func (jl jobsByIdDesc) Len() int {
+	return len(jl)
+}
+
+func (jl jobsByIdDesc) Less(i, j int) bool {
+	return jl[i].Id > jl[j].Id
+}
+
+func (jl jobsByIdDesc) Swap(i, j int) {
+	jl[i], jl[j] = jl[j], jl[i]
+}
+
+// sorts finished jobs oldest first.
+type jobsByFinish []*JobRequest
+
+func (jl jobsByFinish) Len() int {
+	return len(jl)
+}
+
+func (jl jobsByFinish) Less(i, j int) bool {
+	if jl[i].Finished == jl[j].Finished {
+		return jl[i].Id < jl[j].Id
+	}
+	return jl[i].Finished < jl[j].Finished
+}
+
+func (jl jobsByFinish) Swap(i, j int) {
+	jl[i], jl[j] = jl[j], jl[i]
+}
+
 // Ugh.
 func (job *JobRequest) updateState() {
+	// once a job has finished, results that turn up late don't change
+	// how it went.
+	if !job.IsTerminal() {
+		job.State = job.scopeState()
+	}
+	if job.DependencyFailed {
+		job.State = JOB_FAILED_DEPENDENCY
+	} else if job.Cancelled {
+		job.applyCancellation()
+	}
+	if job.IsTerminal() && job.Finished == 0 {
+		job.Finished = time.Nanoseconds()
+	}
+}
+
+// work out the job's state from its results.
+func (job *JobRequest) scopeState() int {
 	switch job.Scope {
 	case SCOPE_ONEOF:
 		// look for a success (any success) in the responses
-		var success bool = false
 		for _, res := range job.results {
 			if res.State == RESP_FINISHED {
-				success = true
-				break
+				return JOB_SUCCESSFUL
 			}
 		}
-		// update the job state based upon these findings
-		if success {
-			job.State = JOB_SUCCESSFUL
-		} else {
-			if len(job.Players) < 1 {
-				job.State = JOB_FAILED
-			} else {
-				job.State = JOB_PENDING
-			}
+		if len(job.Players) < 1 {
+			return JOB_FAILED
 		}
+		return JOB_PENDING
 	case SCOPE_ALLOF:
 		var success int = 0
 		var failed  int = 0
@@ -186,19 +439,100 @@ func (job *JobRequest) updateState() {
 			}
 		}
 		if (success + failed) < len(job.Players) {
-			job.State = JOB_PENDING
+			return JOB_PENDING
 		} else if success == len(job.Players) {
-			job.State = JOB_SUCCESSFUL
+			return JOB_SUCCESSFUL
 		} else if failed == len(job.Players) {
-			job.State = JOB_FAILED
-		} else {
-			job.State = JOB_FAILED_PARTIAL
+			return JOB_FAILED
+		}
+		return JOB_FAILED_PARTIAL
+	case SCOPE_ANYOF:
+		fallthrough
+	case SCOPE_QUORUM:
+		return job.quorumState()
+	}
+	return job.State
+}
+
+// A quorum job is finished as soon as it has enough successes, or as
+// soon as it can no longer get them.
+func (job *JobRequest) quorumState() int {
+	var success int = 0
+	var failed int = 0
+	for _, res := range job.results {
+		if res.DidFail() {
+			failed++
+		} else if res.State == RESP_FINISHED {
+			success++
+		}
+	}
+	var outstanding int = 0
+	for _, task := range job.Tasks {
+		if task.State != TASK_FINISHED {
+			outstanding++
+		}
+	}
+	switch {
+	case success >= job.Quorum:
+		return JOB_SUCCESSFUL
+	case success + outstanding >= job.Quorum:
+		return JOB_PENDING
+	case success == 0:
+		return JOB_FAILED
+	}
+	return JOB_FAILED_PARTIAL
+}
+
+// A cancelled job is finished once none of its tasks are outstanding.
+// If all the tasks managed to complete anyway, the job keeps the state
+// it earned - otherwise it's cancelled.
+func (job *JobRequest) applyCancellation() {
+	for _, task := range job.Tasks {
+		if task.State != TASK_FINISHED {
+			job.State = JOB_PENDING
+			return
+		}
+	}
+	if job.State == JOB_PENDING {
+		job.State = JOB_CANCELLED
+		return
+	}
+	for _, res := range job.results {
+		if res.State == RESP_CANCELLED {
+			job.State = JOB_CANCELLED
+			return
 		}
 	}
 }
 
 func manageRegistry() {
 	jobRegister := make(map[uint64]*JobRequest)
+	// the highest job ID we've evicted.  Anything at or below this
+	// that we don't know about has been expired.
+	var expiredMark uint64 = 0
+	// subscribers, by job ID.  Those under 0 get everything.
+	subscriptions := make(map[uint64][]*JobSubscription)
+
+	publish := func(ev *JobEvent) {
+		for _, sub := range subscriptions[ev.Id] {
+			sub.publish(ev)
+		}
+		for _, sub := range subscriptions[0] {
+			sub.publish(ev)
+		}
+	}
+	// recalculate the job's state, and tell everybody if it changed.
+	review := func(job *JobRequest) {
+		oldState := job.State
+		job.updateState()
+		if job.State != oldState {
+			ev := new(JobEvent)
+			ev.Id = job.Id
+			ev.State = job.State
+			ev.OldState = oldState
+			publish(ev)
+		}
+	}
 
 	for {
 		req := <- chanRequest
@@ -208,6 +542,10 @@ func manageRegistry() {
 			if nil != req.job {
 				// ensure that the players are sorted!
 				sort.Strings(req.job.Players)
+				sort.Strings(req.job.Targets)
+				if req.job.Created == 0 {
+					req.job.Created = time.Nanoseconds()
+				}
 				// update the state
 				req.job.updateState()
 				// and register the job
@@ -228,6 +566,12 @@ func manageRegistry() {
 			resp.success = exists
 			if exists {
 				job.results[req.player] = req.tresp
+				ev := new(JobEvent)
+				ev.Id = job.Id
+				ev.Player = req.player
+				ev.State = req.tresp.State
+				ev.Result = req.tresp
+				publish(ev)
 			}
 		case requestGetJobResult:
 			job, exists := jobRegister[req.id]
@@ -255,13 +599,13 @@ func manageRegistry() {
 			job, exists := jobRegister[req.id]
 			if exists {
 				idx := sort.Search(len(job.Players), func(idx int) bool { return job.Players[idx] >= req.player })
-				if (job.Players[idx] == req.player) {
+				if idx < len(job.Players) && job.Players[idx] == req.player {
 					resp.success = true
 					newplayers := make([]string, len(job.Players)-1)
 					copy(newplayers[0:idx], job.Players[0:idx])
 					copy(newplayers[idx:len(job.Players)-1], job.Players[idx+1:len(job.Players)])
 					job.Players = newplayers
-					job.updateState()
+					review(job)
 				} else {
 					resp.success = false
 				}
@@ -272,8 +616,109 @@ func manageRegistry() {
 			job, exists := jobRegister[req.id]
 			resp.success = exists
 			if exists {
-				job.updateState()
+				review(job)
+			}
+		case requestGetJobRecord:
+			job, exists := jobRegister[req.id]
+			resp.success = exists
+			if exists {
+				resp.record = job.record()
+			}
+		case requestMarkJobFinished:
+			job, exists := jobRegister[req.id]
+			resp.success = exists
+			if exists && job.Finished == 0 {
+				job.Finished = time.Nanoseconds()
+			}
+		case requestExpireJobs:
+			var finished jobsByFinish
+			cutoff := time.Nanoseconds() - req.maxAge
+			for id, job := range jobRegister {
+				if job.Finished == 0 {
+					continue
+				}
+				if req.maxAge > 0 && job.Finished < cutoff {
+					resp.ids = append(resp.ids, id)
+					jobRegister[id] = nil, false
+					continue
+				}
+				finished = append(finished, job)
+			}
+			if req.maxCount > 0 && len(finished) > req.maxCount {
+				sort.Sort(finished)
+				for _, job := range finished[0:len(finished)-req.maxCount] {
+					resp.ids = append(resp.ids, job.Id)
+					jobRegister[job.Id] = nil, false
+				}
+			}
+			for _, id := range resp.ids {
+				if id > expiredMark {
+					expiredMark = id
+				}
+			}
+			resp.success = true
+		case requestIsJobExpired:
+			_, exists := jobRegister[req.id]
+			resp.success = !exists && req.id <= expiredMark
+		case requestCancelJob:
+			job, exists := jobRegister[req.id]
+			if exists && !job.IsTerminal() {
+				job.Cancelled = true
+				resp.success = true
+			}
+		case requestFailDependency:
+			job, exists := jobRegister[req.id]
+			if exists && !job.IsTerminal() {
+				job.DependencyFailed = true
+				resp.success = true
+				review(job)
+			}
+		case requestListJobs:
+			var matches jobsByIdDesc
+			for _, job := range jobRegister {
+				if job.matches(req.filter) {
+					matches = append(matches, job)
+				}
+			}
+			sort.Sort(matches)
+			if req.filter.Limit > 0 && len(matches) > req.filter.Limit {
+				matches = matches[0:req.filter.Limit]
+				resp.more = true
+			}
+			resp.jobs = matches
+			resp.success = true
+		case requestSubscribe:
+			if req.id != 0 {
+				job, exists := jobRegister[req.id]
+				if !exists {
+					break
+				}
+				resp.record = job.record()
+			}
+			resp.sub = newJobSubscription(req.id)
+			subscriptions[req.id] = append(subscriptions[req.id], resp.sub)
+			resp.success = true
+		case requestUnsubscribe:
+			subs := subscriptions[req.sub.Id]
+			for i, sub := range subs {
+				if sub == req.sub {
+					copy(subs[i:], subs[i+1:])
+					subs = subs[0:len(subs)-1]
+					sub.cancel()
+					resp.success = true
+					break
+				}
+			}
+			if len(subs) > 0 {
+				subscriptions[req.sub.Id] = subs
+			} else {
+				subscriptions[req.sub.Id] = nil, false
+			}
+		case requestSetExpiredMark:
+			if req.id > expiredMark {
+				expiredMark = req.id
 			}
+			resp.success = true
 		}
 		if req.responseChannel != nil {
 			req.responseChannel <- resp
@@ -38,6 +38,43 @@ const (
 
 	SCOPE_ONEOF
 	SCOPE_ALLOF
+
+	// Job was cancelled by the audience before it could complete.
+	JOB_CANCELLED
+	// Task was cancelled before it completed.
+	RESP_CANCELLED
+
+	// Run on Quorum of the players.
+	SCOPE_ANYOF
+	// Run on all of the players, but Quorum successes will do.
+	SCOPE_QUORUM
+
+	// Task is part of a rolling job, and is waiting for the earlier
+	// batches to finish before it can be queued.
+	TASK_HELD
+	// Task was never run because the rollout was halted.  Internal
+	// state, not wire.
+	RESP_SKIPPED
+
+	// Job was never run because the jobs it depended on didn't turn
+	// out the way it needed.
+	JOB_FAILED_DEPENDENCY
+
+	// Task ran for longer than it was allowed to, and was killed.
+	RESP_TIMED_OUT
+	// Task was never run because its parameters didn't match the
+	// score's schema.
+	RESP_INVALID_PARAMS
+)
+
+// When a job that depends on others may run.
+const (
+	// all of them succeeded.
+	DEPEND_ON_SUCCESS	= iota
+	// all of them finished, and at least one didn't succeed.
+	DEPEND_ON_FAILURE
+	// all of them finished, however that turned out.
+	DEPEND_ALWAYS
 )
 
 
@@ -46,10 +83,43 @@ type JobRequest struct {
 	Score		string
 	Scope		int
 	Players		[]string
+	// the players, groups and tags the audience asked for, before
+	// they were expanded into Players.
+	Requested	[]string
+	// what Requested expanded to.  Players shrinks as players are
+	// disqualified from floating jobs, but this doesn't.
+	Targets		[]string
 	Id		uint64
 	State		int
+	// the number of successes needed for SCOPE_ANYOF and
+	// SCOPE_QUORUM jobs.
+	Quorum		int
+	// for rolling all-of jobs, how many tasks to release at a time,
+	// and how many failures to put up with before we give up.
+	Batch		int
+	FailureBudget	int
+	// dispatch order.  Higher goes first.
+	Priority	int
+	// for delayed jobs, the time (in ns) before which it can't start.
+	NotBefore	int64
+	// the jobs that must finish before this one can start, and
+	// which DEPEND_ condition they must meet.
+	DependsOn	[]uint64
+	Condition	int
+	// Set if DependsOn can't be satisfied.
+	DependencyFailed	bool
+	// how long (in seconds) the score may run for, if that's less
+	// than the score allows.  0 leaves it to the score.
+	Timeout		int
 	Params		map[string]string
 	Tasks		[]*TaskRequest
+	// Set once the audience has asked for the job to be stopped.
+	Cancelled	bool
+	// Times (in ns) the job was registered and reached a final state.
+	Created		int64
+	Finished	int64
+	// Who asked for the job, if the audience interface could tell us.
+	Submitter	string
 	// These are private - you need to use the registry to access these
 	results		map[string]*TaskResponse
 
@@ -62,11 +132,17 @@ type TaskRequest struct {
 	Player		string
 	State		int
 	RetryTime	int64
+	// the player the dispatcher has picked for a floating task, until
+	// that player's client takes it.  Conductor only.
+	ClaimedBy	string
 }
 type TaskResponse struct {
 	State		int
 	Id		uint64
 	Response	map[string]string
+	// the end of what the score wrote to stdout and stderr.
+	Stdout		string
+	Stderr		string
 	// player only fields
 	RetryTime	int64
 }
@@ -112,6 +188,9 @@ func JobFromProto(ptr *ProtoTaskRequest) (j *JobRequest) {
 	j.Score = *(ptr.Jobname)
 	j.Id = *(ptr.Id)
 	j.Params = mapFromJobParameters(ptr.Parameters)
+	if ptr.Timeout != nil {
+		j.Timeout = int(*ptr.Timeout)
+	}
 
 	return j
 }
@@ -122,6 +201,9 @@ func (task *TaskRequest) Encode() (ptr *ProtoTaskRequest) {
 	ptr.Id = new(uint64)
 	*ptr.Id = task.Job.Id
 	ptr.Parameters = jobParametersFromMap(task.Job.Params)
+	if task.Job.Timeout > 0 {
+		ptr.Timeout = proto.Uint32(uint32(task.Job.Timeout))
+	}
 
 	return ptr
 }
@@ -151,7 +233,11 @@ func (req *JobRequest) MakeTasks() (tasks []*TaskRequest) {
 	switch (req.Scope) {
 	case SCOPE_ONEOF:
 		numtasks = 1
+	case SCOPE_ANYOF:
+		numtasks = req.Quorum
 	case SCOPE_ALLOF:
+		fallthrough
+	case SCOPE_QUORUM:
 		numtasks = len(req.Players)
 	}
 	tasks = make([]*TaskRequest, numtasks)
@@ -160,7 +246,7 @@ func (req *JobRequest) MakeTasks() (tasks []*TaskRequest) {
 		t := new(TaskRequest)
 		t.State = TASK_QUEUED
 		t.Job = req
-		if (req.Scope == SCOPE_ALLOF) {
+		if !req.IsFloating() {
 			t.Player = req.Players[c]
 		}
 		tasks[c] = t
@@ -168,6 +254,60 @@ func (req *JobRequest) MakeTasks() (tasks []*TaskRequest) {
 	return tasks
 }
 
+// true if the job has reached a final state.  Only meaningful on the
+// conductor.
+func (req *JobRequest) IsTerminal() bool {
+	return IsTerminalState(req.State)
+}
+
+// true if state is one of the final JOB_ states.
+func IsTerminalState(state int) bool {
+	switch state {
+	case JOB_SUCCESSFUL:
+		fallthrough
+	case JOB_FAILED_PARTIAL:
+		fallthrough
+	case JOB_FAILED:
+		fallthrough
+	case JOB_CANCELLED:
+		fallthrough
+	case JOB_FAILED_DEPENDENCY:
+		return true
+	}
+	return false
+}
+
+// true if the job's tasks may be run by any of its players, rather than
+// being tied to one each.
+func (req *JobRequest) IsFloating() bool {
+	return req.Scope == SCOPE_ONEOF || req.Scope == SCOPE_ANYOF
+}
+
+// true if player is already doing (or has done, or is about to be given)
+// one of the job's tasks other than except.
+func (req *JobRequest) playerBusy(player string, except *TaskRequest) bool {
+	for _, task := range req.Tasks {
+		if task == except {
+			continue
+		}
+		if task.Player == player || task.ClaimedBy == player {
+			return true
+		}
+	}
+	return false
+}
+
+// true if there's a player left that could pick up task if it was
+// requeued.
+func (req *JobRequest) HasSpareTarget(task *TaskRequest) bool {
+	for _, player := range req.Players {
+		if !req.playerBusy(player, task) {
+			return true
+		}
+	}
+	return false
+}
+
 func (req *JobRequest) Valid() bool {
 	if (len(req.Players) <= 0) {
 		return false
@@ -182,8 +322,9 @@ func (task *TaskRequest) IsTarget(player string) (valid bool) {
 	valid = false
 	if task.Player == "" {
 		n := sort.SearchStrings(task.Job.Players, player)
-		if task.Job.Players[n] == player {
-			valid = true
+		if n < len(task.Job.Players) && task.Job.Players[n] == player {
+			// a player can only work on one task per job.
+			valid = !task.Job.playerBusy(player, task)
 		}
 	} else {
 		if task.Player == player {
@@ -219,10 +360,22 @@ func (resp *TaskResponse) Encode() (ptr *ProtoTaskResponse) {
 		ptr.Status = NewProtoTaskResponse_TaskStatus(ProtoTaskResponse_JOB_HOST_FAILURE)
 	case RESP_FAILED_UNKNOWN:
 		ptr.Status = NewProtoTaskResponse_TaskStatus(ProtoTaskResponse_JOB_UNKNOWN_FAILURE)
+	case RESP_CANCELLED:
+		ptr.Status = NewProtoTaskResponse_TaskStatus(ProtoTaskResponse_JOB_CANCELLED)
+	case RESP_TIMED_OUT:
+		ptr.Status = NewProtoTaskResponse_TaskStatus(ProtoTaskResponse_JOB_TIMED_OUT)
+	case RESP_INVALID_PARAMS:
+		ptr.Status = NewProtoTaskResponse_TaskStatus(ProtoTaskResponse_JOB_INVALID_PARAMS)
 	}
 	ptr.Id = new(uint64)
 	*ptr.Id = resp.Id
 	ptr.Response = jobParametersFromMap(resp.Response)
+	if resp.Stdout != "" {
+		ptr.Stdout = proto.String(resp.Stdout)
+	}
+	if resp.Stderr != "" {
+		ptr.Stderr = proto.String(resp.Stderr)
+	}
 
 	return ptr
 }
@@ -239,6 +392,14 @@ func (resp *TaskResponse) IsFinished() bool {
 	case RESP_FAILED_HOST_ERROR:
 		fallthrough
 	case RESP_FAILED_UNKNOWN:
+		fallthrough
+	case RESP_CANCELLED:
+		fallthrough
+	case RESP_SKIPPED:
+		fallthrough
+	case RESP_TIMED_OUT:
+		fallthrough
+	case RESP_INVALID_PARAMS:
 		return true
 	}
 	return false
@@ -285,6 +446,12 @@ func ResponseFromProto(ptr *ProtoTaskResponse) (r *TaskResponse) {
 		r.State = RESP_FAILED_HOST_ERROR
 	case ProtoTaskResponse_JOB_UNKNOWN:
 		r.State = RESP_FAILED_UNKNOWN_SCORE
+	case ProtoTaskResponse_JOB_CANCELLED:
+		r.State = RESP_CANCELLED
+	case ProtoTaskResponse_JOB_TIMED_OUT:
+		r.State = RESP_TIMED_OUT
+	case ProtoTaskResponse_JOB_INVALID_PARAMS:
+		r.State = RESP_INVALID_PARAMS
 	case ProtoTaskResponse_JOB_UNKNOWN_FAILURE:
 		fallthrough
 	default:
@@ -293,6 +460,12 @@ func ResponseFromProto(ptr *ProtoTaskResponse) (r *TaskResponse) {
 
 	r.Id = *(ptr.Id)
 	r.Response = mapFromJobParameters(ptr.Response)
+	if ptr.Stdout != nil {
+		r.Stdout = *ptr.Stdout
+	}
+	if ptr.Stderr != nil {
+		r.Stderr = *ptr.Stderr
+	}
 
 	return r
 }
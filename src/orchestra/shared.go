@@ -12,6 +12,7 @@ import (
 const (
 	DefaultMasterPort = 2258
 	DefaultHTTPPort = 2259
+	DefaultAudiencePort = 2260
 )
 
 var	logWriter, _ = syslog.New(syslog.LOG_DEBUG, "orchestra")
@@ -24,6 +24,7 @@ const (
 	TypeTaskRequest		= 3
 	TypeTaskResponse	= 4
 	TypeAcknowledgement	= 5
+	TypeCancelTask		= 6
 )
 
 var (
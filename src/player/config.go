@@ -22,6 +22,12 @@ func init() {
 	configFile.Add("master", configureit.NewStringOption("conductor"))
 	configFile.Add("score directory", configureit.NewStringOption("/usr/lib/orchestra/scores"))
 	configFile.Add("player name", configureit.NewStringOption(""))
+	configFile.Add("slots", configureit.NewIntOption(1))
+	configFile.Add("score user", configureit.NewStringOption(""))
+	configFile.Add("cgroup root", configureit.NewStringOption("/sys/fs/cgroup/orchestra"))
+	configFile.Add("output tail", configureit.NewIntOption(4))
+	configFile.Add("job retention age", configureit.NewIntOption(86400))
+	configFile.Add("job retention count", configureit.NewIntOption(1000))
 }
 
 func GetStringOpt(key string) string {
@@ -36,6 +42,18 @@ func GetStringOpt(key string) string {
 	return strings.TrimSpace(sopt.Value)
 }
 
+func GetIntOpt(key string) int {
+	cnode := configFile.Get(key)
+	if cnode == nil {
+		o.Assert("tried to get a configuration option that doesn't exist.")
+	}
+	iopt, ok := cnode.(*configureit.IntOption)
+	if !ok {
+		o.Assert("tried to get a non-int configuration option with GetIntOpt")
+	}
+	return iopt.Value
+}
+
 func GetCACertList() []string {
 	cnode := configFile.Get("ca certificates")
 	if cnode == nil {
@@ -0,0 +1,175 @@
+// credentials.go
+//
+// Working out who a score should run as.
+//
+// Scores run as the user named in their configuration, or the player's
+// default score user if they don't name one.  If that isn't set either,
+// a player running as root runs them as nobody, and any other player
+// runs them as itself.  The user's supplementary groups are taken from
+// /etc/group.
+
+package main
+
+import (
+	"os"
+	"bufio"
+	"strconv"
+	"strings"
+	"syscall"
+	"os/user"
+)
+
+const groupFile = "/etc/group"
+
+type ScoreCredentials struct {
+	Username	string
+	HomeDir		string
+	Uid		int
+	Gid		int
+	Groups		[]int
+}
+
+func lookupUser(name string) (u *user.User, err os.Error) {
+	uid, err := strconv.Atoi(name)
+	if err == nil {
+		return user.LookupId(uid)
+	}
+	return user.Lookup(name)
+}
+
+// call fn for each entry in the group file.  Stops early if fn returns
+// false.
+func eachGroup(fn func(name string, gid int, members []string) bool) os.Error {
+	fh, err := os.Open(groupFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+	for {
+		lb, _, err := r.ReadLine()
+		if err == os.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line := strings.TrimSpace(string(lb))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		if !fn(fields[0], gid, members) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func lookupGroup(name string) (gid int, err os.Error) {
+	gid, err = strconv.Atoi(name)
+	if err == nil {
+		return gid, nil
+	}
+	found := false
+	err = eachGroup(func(gname string, ggid int, members []string) bool {
+		if gname == name {
+			gid = ggid
+			found = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, os.NewError("unknown group \"" + name + "\"")
+	}
+	return gid, nil
+}
+
+// the groups username is a member of, besides gid.
+func supplementaryGroups(username string, gid int) (groups []int, err os.Error) {
+	groups = append(groups, gid)
+	err = eachGroup(func(gname string, ggid int, members []string) bool {
+		if ggid == gid {
+			return true
+		}
+		for _, member := range members {
+			if member == username {
+				groups = append(groups, ggid)
+				break
+			}
+		}
+		return true
+	})
+	return groups, err
+}
+
+// the user to run a score that doesn't name one as, or "" to run it as
+// the player's own user.
+func defaultScoreUser() string {
+	username := GetStringOpt("score user")
+	if username == "" && os.Geteuid() == 0 {
+		username = "nobody"
+	}
+	return username
+}
+
+// Work out the credentials for a user (by name or uid), and
+// optionally a group to use instead of the user's own.
+func ResolveCredentials(username, groupname string) (sc *ScoreCredentials, err os.Error) {
+	u, err := lookupUser(username)
+	if err != nil {
+		return nil, os.NewError("unknown user \"" + username + "\": " + err.String())
+	}
+	sc = new(ScoreCredentials)
+	sc.Username = u.Username
+	sc.HomeDir = u.HomeDir
+	sc.Uid = u.Uid
+	sc.Gid = u.Gid
+	if groupname != "" {
+		sc.Gid, err = lookupGroup(groupname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sc.Groups, err = supplementaryGroups(sc.Username, sc.Gid)
+	if err != nil {
+		return nil, os.NewError("couldn't read groups: " + err.String())
+	}
+	return sc, nil
+}
+
+// The credentials to start the score with, or nil if we don't need to
+// change anything.
+func (sc *ScoreCredentials) SysCredential() (cred *syscall.Credential, err os.Error) {
+	if os.Geteuid() != 0 {
+		// we can't switch users, so we'd better already be
+		// the right one.
+		if sc.Uid != os.Geteuid() {
+			return nil, os.NewError("can't run as \"" + sc.Username + "\" - the player isn't running as root")
+		}
+		return nil, nil
+	}
+	cred = new(syscall.Credential)
+	cred.Uid = uint32(sc.Uid)
+	cred.Gid = uint32(sc.Gid)
+	for _, gid := range sc.Groups {
+		cred.Groups = append(cred.Groups, uint32(gid))
+	}
+	return cred, nil
+}
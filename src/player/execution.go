@@ -6,22 +6,122 @@ import (
 	"os"
 	"bufio"
 	"strings"
+	"syscall"
+	"time"
 	o "orchestra"
 )
 
-func ExecuteJob(job *o.JobRequest) <-chan *o.TaskResponse {
-	complete  := make(chan *o.TaskResponse, 1)
-	go doExecution(job, complete)
+const (
+	KillGraceDelay = 5e9 // give a process 5 seconds to die after TERM before we KILL it.
+)
+
+type runningJob struct {
+	score		string
+	abort		chan<- int
+}
+
+var (
+	// the jobs we're currently executing.
+	// Only to be touched from the ProcessingLoop.
+	runningJobs	= make(map[uint64]*runningJob)
+	// how many of each score are running.
+	runningScores	= make(map[string]int)
+)
+
+// Start executing a job.  The job's response is sent to complete once
+// it has finished.
+func ExecuteJob(job *o.JobRequest, complete chan<- *o.TaskResponse) {
+	abort := make(chan int, 1)
+	rj := new(runningJob)
+	rj.score = job.Score
+	rj.abort = abort
+	runningJobs[job.Id] = rj
+	runningScores[job.Score]++
+	go doExecution(job, complete, abort)
+}
+
+// The number of jobs currently executing.
+func RunningJobCount() int {
+	return len(runningJobs)
+}
+
+// true if another instance of the job's score can be started without
+// going over the score's slot limit.
+func CanRunScore(name string) bool {
+	return scoreHasRoom(name, 0)
+}
+
+// true if the score could start another job, on top of those running
+// and extra more.
+func scoreHasRoom(name string, extra int) bool {
+	score, exists := Scores[name]
+	if !exists || score.Slots <= 0 {
+		// unknown scores fail straight away.
+		return true
+	}
+	return runningScores[name] + extra < score.Slots
+}
+
+// Ask a running job to stop.  Returns false if we aren't running it.
+func AbortJob(id uint64) bool {
+	rj, exists := runningJobs[id]
+	if !exists {
+		return false
+	}
+	select {
+	case rj.abort <- 1:
+	default:
+		// already asked.
+	}
+	return true
+}
 
-	return complete
+// Forget about a job once it has completed.
+func JobCompleted(id uint64) {
+	rj, exists := runningJobs[id]
+	if !exists {
+		return
+	}
+	runningScores[rj.score]--
+	if runningScores[rj.score] <= 0 {
+		runningScores[rj.score] = 0, false
+	}
+	runningJobs[id] = nil, false
+}
+
+type waitResult struct {
+	wm	*os.Waitmsg
+	err	os.Error
+}
+
+func waitProcess(proc *os.Process, c chan<- *waitResult) {
+	wr := new(waitResult)
+	wr.wm, wr.err = proc.Wait(0)
+	c <- wr
 }
 
-func batchLogger(jobid uint64, errpipe *os.File) {
+// Terminate the process group led by proc.  We ask nicely first, and
+// then KILL it if it hasn't gone away after the grace period.
+func killProcessGroup(jobid uint64, proc *os.Process, waitChan <-chan *waitResult) *waitResult {
+	o.Warn("Job %d: Sending TERM to process group %d", jobid, proc.Pid)
+	syscall.Kill(-proc.Pid, syscall.SIGTERM)
+	select {
+	case wr := <-waitChan:
+		return wr
+	case <-time.After(KillGraceDelay):
+	}
+	o.Warn("Job %d: Sending KILL to process group %d", jobid, proc.Pid)
+	syscall.Kill(-proc.Pid, syscall.SIGKILL)
+	return <-waitChan
+}
+
+// log the score's stderr, and keep the end of it in tail.
+func batchLogger(jobid uint64, errpipe *os.File, tail *outputTail) {
 	defer errpipe.Close()
 
 	r := bufio.NewReader(errpipe)
 	for {
-		lb, _, err := r.ReadLine()
+		lb, isPrefix, err := r.ReadLine()
 		if err == os.EOF {
 			return
 		}
@@ -30,6 +130,10 @@ func batchLogger(jobid uint64, errpipe *os.File) {
 			return
 		}
 		o.Info("JOB %d:STDERR:%s", jobid, string(lb))
+		tail.Write(lb)
+		if !isPrefix {
+			tail.Write([]byte{'\n'})
+		}
 	}
 }
 
@@ -49,7 +153,7 @@ func peSetEnv(env []string, key string, value string) []string {
 	return env
 }
 
-func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
+func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse, abort <-chan int) {
 	// we must notify the parent when we exit.
 	defer func(c chan<- *o.TaskResponse, job *o.JobRequest) { c <- job.MyResponse }(completionChannel,job)
 
@@ -60,6 +164,38 @@ func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
 		job.MyResponse.State = o.RESP_FAILED_UNKNOWN_SCORE
 		return
 	}
+	// make sure the parameters are what the score expects.
+	perrs := score.Params.Validate(job.Params)
+	if nil != perrs {
+		names := paramErrorNames(perrs)
+		o.Warn("Job %d: Invalid parameters for %s: %s", job.Id, job.Score, strings.Join(names, ", "))
+		job.MyResponse.State = o.RESP_INVALID_PARAMS
+		job.MyResponse.Response["reason"] = "invalid parameters: " + strings.Join(names, ", ")
+		for _, name := range names {
+			job.MyResponse.Response["param."+name] = perrs[name]
+		}
+		return
+	}
+	// work out who we're running it as.
+	username := score.User
+	if username == "" {
+		username = defaultScoreUser()
+	}
+	var syscred *syscall.Credential = nil
+	var err os.Error = nil
+	if username != "" {
+		var creds *ScoreCredentials
+		creds, err = ResolveCredentials(username, score.Group)
+		if err == nil {
+			syscred, err = creds.SysCredential()
+		}
+	}
+	if err != nil {
+		o.Warn("Job %d: Refusing to run %s: %s", job.Id, job.Score, err)
+		job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+		job.MyResponse.Response["reason"] = err.String()
+		return
+	}
 	si := NewScoreInterface(job)
 	if si == nil {
 		o.Warn("Job %d: Couldn't initialise Score Interface", job.Id)
@@ -68,9 +204,20 @@ func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
 	}
 	if !si.Prepare() {
 		o.Warn("Job %d: Couldn't Prepare Score Interface", job.Id)
-		job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+		// the interface may have said why already.
+		if !job.MyResponse.IsFinished() {
+			job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+		}
 		return
 	}
+	// the output tails go in last, once the interface has had its
+	// say, so we can make sure they fit.
+	tailKb := GetIntOpt("output tail")
+	if tailKb > maxOutputTail {
+		tailKb = maxOutputTail
+	}
+	output := newScoreOutput(tailKb * 1024)
+	defer output.Attach(job.MyResponse)
 	defer si.Cleanup()
 
 	eenv := si.SetupProcess()
@@ -78,15 +225,20 @@ func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
 
 	procenv := new(os.ProcAttr)
 	// Build the default environment.
-	procenv.Env = peSetEnv(procenv.Env, "PATH", "/usr/bin:/usr/sbin:/bin:/sbin")
 	procenv.Env = peSetEnv(procenv.Env, "IFS", " \t\n")
-	pwd, err := os.Getwd()
-	if err != nil {
-		job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
-		o.Warn("Job %d: Couldn't resolve PWD: %s", job.Id, err)
-		return
+	pwd := score.InitialPwd
+	if pwd == "" {
+		pwd = "/"
 	}
+	procenv.Dir = pwd
 	procenv.Env = peSetEnv(procenv.Env, "PWD", pwd)
+	procenv.Env = peSetEnv(procenv.Env, "USER", creds.Username)
+	procenv.Env = peSetEnv(procenv.Env, "LOGNAME", creds.Username)
+	procenv.Env = peSetEnv(procenv.Env, "HOME", creds.HomeDir)
+	// then the score's PATH and environment
+	for k, v := range score.InitialEnv {
+		procenv.Env = peSetEnv(procenv.Env, k, v)
+	}
 	// copy in the environment overrides
 	for k, v := range eenv.Environment {
 		procenv.Env = peSetEnv(procenv.Env, k, v)
@@ -105,9 +257,19 @@ func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
 	// attach STDERR to to our logger via pipe.
 	lr, lw, err := os.Pipe()
 	o.MightFail(err, "Couldn't create pipe")
-	defer lw.Close()
 	// lr will be closed by the logger.
 	procenv.Files[2] = lw
+	output.AddChildFile(lw)
+	defer output.CloseChildFiles()
+	output.Start(func() { batchLogger(job.Id, lr, output.stderr) })
+	// and unless the interface wants it, STDOUT to the output tail.
+	if output.Enabled() && (len(eenv.Files) < 2 || nil == eenv.Files[1]) {
+		stdoutr, stdoutw, err := os.Pipe()
+		o.MightFail(err, "Couldn't create pipe")
+		procenv.Files[1] = stdoutw
+		output.AddChildFile(stdoutw)
+		output.Start(func() { tailCopy(stdoutr, output.stdout) })
+	}
 	// check the environment's configuration and allow it to override stdin, stdout, and FDs 3+
 	if nil != eenv.Files {
 		for i := range eenv.Files {
@@ -118,18 +280,104 @@ func doExecution(job *o.JobRequest, completionChannel chan<- *o.TaskResponse) {
 			}
 		}
 	}
-	var args []string = nil
+	args := []string{score.Executable}
 	args = append(args, eenv.Arguments...)
 
-	o.Info("Job %d: Executing %s", job.Id, score.Executable)
-	go batchLogger(job.Id, lr)
-	proc, err := os.StartProcess(score.Executable, args, procenv)
+	// run the score in its own process group so we can take out
+	// anything it spawns if we have to kill it.
+	procenv.Sys = new(syscall.SysProcAttr)
+	procenv.Sys.Setpgid = true
+	procenv.Sys.Credential = syscred
+
+	// limited scores are started via the exec helper.
+	executable := score.Executable
+	var hp *helperPipes = nil
+	var cg *ScoreCgroup = nil
+	if score.Limits.NeedsHelper() {
+		if score.Limits.HasCgroup() {
+			cg, err = NewScoreCgroup(job.Id, score.Limits)
+			if err != nil {
+				o.Warn("Job %d: Couldn't create cgroup: %s", job.Id, err)
+				job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+				job.MyResponse.Response["reason"] = "couldn't create cgroup: " + err.String()
+				return
+			}
+			defer cg.Destroy()
+		}
+		executable, args, hp, err = setupHelper(score.Limits, score.Executable, args, procenv)
+		if err != nil {
+			o.Warn("Job %d: Couldn't set up exec helper: %s", job.Id, err)
+			job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+			return
+		}
+	}
+
+	o.Info("Job %d: Executing %s as %s", job.Id, score.Executable, creds.Username)
+	proc, err := os.StartProcess(executable, args, procenv)
+	if nil != hp {
+		hp.Started()
+	}
+	// the score has its own copies of these now.
+	output.CloseChildFiles()
 	if err != nil {
 		o.Warn("Job %d: Failed to start processs", job.Id)
+		if nil != hp {
+			hp.Abandon()
+		}
 		job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
 		return
 	}
-	wm, err := proc.Wait(0)
+	if nil != hp {
+		if nil != cg {
+			err = cg.AddProcess(proc.Pid)
+		}
+		if err == nil {
+			err = hp.Release()
+		} else {
+			hp.Abandon()
+		}
+		if err != nil {
+			o.Warn("Job %d: Couldn't start score: %s", job.Id, err)
+			job.MyResponse.State = o.RESP_FAILED_HOST_ERROR
+			job.MyResponse.Response["reason"] = err.String()
+			proc.Kill()
+			proc.Wait(0)
+			return
+		}
+	}
+	if nil != cg {
+		// this has to happen before the cgroup is destroyed.
+		defer cg.Report(job.Id, job.MyResponse)
+	}
+	waitChan := make(chan *waitResult, 1)
+	go waitProcess(proc, waitChan)
+
+	// the job may ask for less time than the score allows, but not
+	// more.
+	timeout := score.Timeout
+	if job.Timeout > 0 && (timeout <= 0 || job.Timeout < timeout) {
+		timeout = job.Timeout
+	}
+	var timeoutChan <-chan int64 = nil
+	if timeout > 0 {
+		timeoutChan = time.After(int64(timeout) * 1e9)
+	}
+
+	var wr *waitResult
+	select {
+	case wr = <-waitChan:
+	case <-abort:
+		o.Warn("Job %d: Cancelled - killing process", job.Id)
+		killProcessGroup(job.Id, proc, waitChan)
+		job.MyResponse.State = o.RESP_CANCELLED
+		return
+	case <-timeoutChan:
+		o.Warn("Job %d: Timed out after %d seconds - killing process", job.Id, timeout)
+		killProcessGroup(job.Id, proc, waitChan)
+		job.MyResponse.State = o.RESP_TIMED_OUT
+		return
+	}
+	wm, err := wr.wm, wr.err
 	if err != nil {
 		o.Warn("Job %d: Error waiting for process", job.Id)
 		job.MyResponse.State = o.RESP_FAILED_UNKNOWN
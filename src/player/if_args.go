@@ -0,0 +1,223 @@
+// if_args
+//
+// 'args' score interface
+//
+// The ARGS score interface passes the job's parameters to the score on
+// its command line, according to the 'args' template in the score's
+// .conf file, eg:
+//
+//	args = --host={{host}} --force={{force|default:false}}
+//
+// The template is split into words before anything is substituted, so
+// a parameter always ends up in the word it was written in, whatever it
+// contains.  Words may be quoted with ' or " to include spaces.  A
+// word that was nothing but parameters, and which expands to nothing,
+// is left out altogether.
+
+package main
+
+import (
+	"os"
+	"strings"
+	o "orchestra"
+)
+
+func init() {
+	RegisterInterface("args", newArgsInterface)
+}
+
+type argPart struct {
+	// either literal text, or a parameter.
+	literal		string
+	param		string
+	hasDefault	bool
+	def		string
+}
+
+type argWord []*argPart
+
+type ArgTemplate []argWord
+
+func isParamNameChar(c int) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.'
+}
+
+// parse '{{name}}' or '{{name|default:value}}', without the braces.
+func parseArgParam(spec string) (part *argPart, err os.Error) {
+	part = new(argPart)
+	bits := strings.SplitN(spec, "|", 2)
+	part.param = strings.TrimSpace(bits[0])
+	if part.param == "" {
+		return nil, os.NewError("empty parameter name")
+	}
+	for _, c := range part.param {
+		if !isParamNameChar(c) {
+			return nil, os.NewError("bad parameter name \"" + part.param + "\"")
+		}
+	}
+	if len(bits) == 2 {
+		if !strings.HasPrefix(bits[1], "default:") {
+			return nil, os.NewError("unknown modifier \"" + bits[1] + "\"")
+		}
+		part.hasDefault = true
+		part.def = bits[1][len("default:"):]
+	}
+	return part, nil
+}
+
+// split the literal text of a word into parts.
+func parseArgText(text string) (word argWord, err os.Error) {
+	for text != "" {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			word = append(word, &argPart{literal: text})
+			break
+		}
+		if start > 0 {
+			word = append(word, &argPart{literal: text[:start]})
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return nil, os.NewError("unterminated parameter")
+		}
+		part, err := parseArgParam(text[start+2:start+end])
+		if err != nil {
+			return nil, err
+		}
+		word = append(word, part)
+		text = text[start+end+2:]
+	}
+	return word, nil
+}
+
+// split s into words, separated by spaces or tabs.  Words may be
+// quoted with ' or " to include spaces.
+func splitQuotedWords(s string) (words []string, err os.Error) {
+	inWord := false
+	var quote int = 0
+	text := ""
+	for _, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			text += string(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, text)
+				text = ""
+				inWord = false
+			}
+		default:
+			text += string(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, os.NewError("unterminated quote")
+	}
+	if inWord {
+		words = append(words, text)
+	}
+	return words, nil
+}
+
+func ParseArgTemplate(template string) (at ArgTemplate, err os.Error) {
+	words, err := splitQuotedWords(template)
+	if err != nil {
+		return nil, err
+	}
+	for _, text := range words {
+		word, err := parseArgText(text)
+		if err != nil {
+			return nil, err
+		}
+		at = append(at, word)
+	}
+	return at, nil
+}
+
+// the parameters the template refers to.
+func (at ArgTemplate) Params() (params []string) {
+	for _, word := range at {
+		for _, part := range word {
+			if part.param != "" {
+				params = append(params, part.param)
+			}
+		}
+	}
+	return params
+}
+
+// Fill in the template.  missing lists the required parameters that
+// weren't given.
+func (at ArgTemplate) Expand(params map[string]string) (args []string, missing []string) {
+	for _, word := range at {
+		arg := ""
+		onlyParams := true
+		for _, part := range word {
+			if part.param == "" {
+				arg += part.literal
+				onlyParams = false
+				continue
+			}
+			value, exists := params[part.param]
+			if !exists {
+				if !part.hasDefault {
+					missing = append(missing, part.param)
+					continue
+				}
+				value = part.def
+			}
+			arg += value
+		}
+		if arg == "" && onlyParams && len(word) > 0 {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args, missing
+}
+
+type ArgsInterface struct {
+	job	*o.JobRequest
+	args	[]string
+}
+
+func newArgsInterface(job *o.JobRequest) (iface ScoreInterface) {
+	ai := new(ArgsInterface)
+	ai.job = job
+
+	return ai
+}
+
+func (ai *ArgsInterface) Prepare() bool {
+	score, exists := Scores[ai.job.Score]
+	if !exists {
+		return false
+	}
+	args, missing := score.Args.Expand(ai.job.Params)
+	if len(missing) > 0 {
+		o.Warn("Job %d: Missing parameters for %s: %s", ai.job.Id, ai.job.Score, strings.Join(missing, ", "))
+		ai.job.MyResponse.State = o.RESP_FAILED
+		ai.job.MyResponse.Response["reason"] = "missing parameters: " + strings.Join(missing, ", ")
+		return false
+	}
+	ai.args = args
+
+	return true
+}
+
+func (ai *ArgsInterface) SetupProcess() (ee *ExecutionEnvironment) {
+	ee = NewExecutionEnvironment()
+	ee.Arguments = ai.args
+
+	return ee
+}
+
+func (ai *ArgsInterface) Cleanup() {
+	// does nothing!
+}
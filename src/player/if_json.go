@@ -0,0 +1,270 @@
+// if_json
+//
+// 'json' score interface
+//
+// The JSON score interface hands the score the whole job as a JSON
+// document on STDIN, and reads a JSON result object back from FD 3, or
+// from STDOUT if nothing was written to FD 3.  See
+// doc/score_json_interface.txt.
+
+package main
+
+import (
+	"os"
+	"io"
+	"io/ioutil"
+	"json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	o "orchestra"
+)
+
+const (
+	// how long we'll wait for the score's output once it has exited.
+	// Anything it left running in the background may still be
+	// holding the pipes open.
+	jsonDrainTimeout = 5e9
+
+	// the most we'll read of a result.  The response has to fit in
+	// a single wire packet, so there's no point keeping more.
+	maxJsonResult = 32 * 1024
+)
+
+func init() {
+	RegisterInterface("json", newJsonInterface)
+}
+
+// what the score gets on STDIN.
+type JsonScoreRequest struct {
+	Id		uint64
+	Score		string
+	Player		string
+	// seconds, or 0 if the job didn't ask for a timeout.
+	Timeout		int
+	Params		map[string]string
+}
+
+// what the score sends back.
+type JsonScoreResult struct {
+	// "ok" or "failed".  If not given, the exit status decides.
+	Status		*string
+	Message		*string
+	Result		map[string]interface{}
+}
+
+type JsonInterface struct {
+	job		*o.JobRequest
+	// our ends of the pipes.
+	stdinw		*os.File
+	// the score's ends, which we close once it has started.
+	stdinr		*os.File
+	stdoutw		*os.File
+	resultw		*os.File
+	// what the score wrote.
+	stdout		chan *jsonOutput
+	result		chan *jsonOutput
+}
+
+type jsonOutput struct {
+	data		[]byte
+	// the score wrote more than maxJsonResult.
+	tooLarge	bool
+}
+
+func newJsonInterface(job *o.JobRequest) (iface ScoreInterface) {
+	ji := new(JsonInterface)
+	ji.job = job
+
+	return ji
+}
+
+// read up to maxJsonResult from the pipe, and hand it to c.  Anything
+// past that is read and thrown away, so the score doesn't block writing
+// it.
+func jsonReader(r *os.File, c chan<- *jsonOutput) {
+	defer r.Close()
+
+	out := new(jsonOutput)
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxJsonResult+1))
+	if err != nil {
+		o.Warn("jsonReader failed: %s", err)
+	}
+	if len(data) > maxJsonResult {
+		out.tooLarge = true
+		data = nil
+		buf := make([]byte, 4096)
+		for {
+			_, err = r.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+	}
+	out.data = data
+	c <- out
+}
+
+func jsonWriter(w *os.File, data []byte) {
+	defer w.Close()
+
+	// it doesn't matter if the score doesn't want it.
+	w.Write(data)
+}
+
+func (ji *JsonInterface) Prepare() bool {
+	req := new(JsonScoreRequest)
+	req.Id = ji.job.Id
+	req.Score = ji.job.Score
+	req.Player = LocalHostname
+	req.Timeout = ji.job.Timeout
+	req.Params = ji.job.Params
+	data, err := json.Marshal(req)
+	if err != nil {
+		o.Warn("Job %d: Couldn't encode job for score: %s", ji.job.Id, err)
+		return false
+	}
+
+	var pipes [3][2]*os.File
+	for i := range pipes {
+		pipes[i][0], pipes[i][1], err = os.Pipe()
+		if err != nil {
+			for j := 0; j < i; j++ {
+				pipes[j][0].Close()
+				pipes[j][1].Close()
+			}
+			return false
+		}
+	}
+	ji.stdinr, ji.stdinw = pipes[0][0], pipes[0][1]
+	ji.stdoutw = pipes[1][1]
+	ji.resultw = pipes[2][1]
+	ji.stdout = make(chan *jsonOutput, 1)
+	ji.result = make(chan *jsonOutput, 1)
+
+	go jsonWriter(ji.stdinw, data)
+	go jsonReader(pipes[1][0], ji.stdout)
+	go jsonReader(pipes[2][0], ji.result)
+
+	return true
+}
+
+func (ji *JsonInterface) SetupProcess() (ee *ExecutionEnvironment) {
+	ee = NewExecutionEnvironment()
+	ee.Files = make([]*os.File, 3)
+	ee.Files[0] = ji.stdinr
+	ee.Files[1] = ji.stdoutw
+	ee.Files[2] = ji.resultw
+
+	return ee
+}
+
+// wait for a reader to finish, but not past deadline (in ns).  Each
+// reader gets its own timer, so one that's already given up doesn't
+// leave the next waiting forever.
+func jsonDrain(c <-chan *jsonOutput, deadline int64) *jsonOutput {
+	remaining := deadline - time.Nanoseconds()
+	if remaining <= 0 {
+		select {
+		case out := <-c:
+			return out
+		default:
+		}
+		return new(jsonOutput)
+	}
+	select {
+	case out := <-c:
+		return out
+	case <-time.After(remaining):
+	}
+	return new(jsonOutput)
+}
+
+// flatten a result value into the response.  Nested objects and arrays
+// get dotted keys.
+func jsonFlatten(resp map[string]string, key string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k, _ := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if key == "" {
+				jsonFlatten(resp, k, v[k])
+			} else {
+				jsonFlatten(resp, key+"."+k, v[k])
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			jsonFlatten(resp, fmt.Sprintf("%s.%d", key, i), e)
+		}
+	case string:
+		resp[key] = v
+	case float64:
+		resp[key] = fmt.Sprint(v)
+	case bool:
+		resp[key] = fmt.Sprint(v)
+	case nil:
+		resp[key] = ""
+	}
+}
+
+func (ji *JsonInterface) Cleanup() {
+	// close our copies of the score's ends, so the readers see EOF
+	// once the score has gone.
+	ji.stdinr.Close()
+	ji.stdoutw.Close()
+	ji.resultw.Close()
+
+	deadline := time.Nanoseconds() + jsonDrainTimeout
+	result := jsonDrain(ji.result, deadline)
+	stdout := jsonDrain(ji.stdout, deadline)
+	if !result.tooLarge && len(strings.TrimSpace(string(result.data))) == 0 {
+		result = stdout
+	}
+	resp := ji.job.MyResponse
+	if result.tooLarge {
+		o.Warn("Job %d: Result from score is larger than %d bytes", ji.job.Id, maxJsonResult)
+		if resp.State == o.RESP_FINISHED {
+			resp.State = o.RESP_FAILED
+		}
+		resp.Response["error"] = fmt.Sprintf("result too large (more than %d bytes)", maxJsonResult)
+		return
+	}
+	if len(strings.TrimSpace(string(result.data))) == 0 {
+		// nothing to say.  The exit status will do.
+		return
+	}
+
+	jr := new(JsonScoreResult)
+	err := json.Unmarshal(result.data, jr)
+	if err != nil {
+		o.Warn("Job %d: Malformed result from score: %s", ji.job.Id, err)
+		if resp.State == o.RESP_FINISHED {
+			resp.State = o.RESP_FAILED
+		}
+		resp.Response["error"] = "malformed result: " + err.String()
+		return
+	}
+	jsonFlatten(resp.Response, "", jr.Result)
+	if nil != jr.Message {
+		resp.Response["message"] = *jr.Message
+	}
+	// the score can only change its mind about how it went if it
+	// actually finished.
+	if nil != jr.Status && (resp.State == o.RESP_FINISHED || resp.State == o.RESP_FAILED) {
+		switch strings.ToLower(*jr.Status) {
+		case "ok":
+			resp.State = o.RESP_FINISHED
+		case "failed":
+			resp.State = o.RESP_FAILED
+		default:
+			o.Warn("Job %d: Score returned unknown status \"%s\"", ji.job.Id, *jr.Status)
+			resp.State = o.RESP_FAILED
+		}
+	}
+}
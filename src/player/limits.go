@@ -0,0 +1,300 @@
+// limits.go
+//
+// Resource limits for score processes.
+//
+// rlimits can only be set by the process they apply to, and a process
+// has to be moved into a cgroup before it starts doing any work, so
+// limited scores aren't started directly.  Instead we start another
+// copy of the player as an exec helper, running as the score's user.
+// The helper sets the rlimits on itself, waits for us to move it into
+// the score's cgroup, and then execs the score.
+//
+// cgroups are v2 only.  Each job gets its own group under the 'cgroup
+// root', which must already exist and have the controllers we need
+// enabled in its cgroup.subtree_control.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"io/ioutil"
+	o "orchestra"
+)
+
+const (
+	// os.Args[0] for the exec helper.
+	ExecHelperName		= "orchestra-exec-helper"
+
+	helperRlimitsEnv	= "ORCHESTRA_HELPER_RLIMITS"
+	helperFdsEnv		= "ORCHESTRA_HELPER_FDS"
+
+	// not all of the syscall packages know about this one.
+	RLIMIT_NPROC		= 6
+
+	cgroupRemoveAttempts	= 10
+	cgroupRemoveDelay	= 100e6
+)
+
+type ResourceLimits struct {
+	// rlimits.  0 leaves the limit as it is.
+	CpuSeconds	int
+	// in megabytes.
+	AddressSpace	int
+	OpenFiles	int
+	Processes	int
+
+	// cgroup controls, written as is.  "" leaves them alone.
+	MemoryMax	string
+	CpuMax		string
+	PidsMax		string
+}
+
+func (rl *ResourceLimits) HasRlimits() bool {
+	return rl.CpuSeconds > 0 || rl.AddressSpace > 0 || rl.OpenFiles > 0 || rl.Processes > 0
+}
+
+func (rl *ResourceLimits) HasCgroup() bool {
+	return rl.MemoryMax != "" || rl.CpuMax != "" || rl.PidsMax != ""
+}
+
+// true if the score has to be started via the exec helper.
+func (rl *ResourceLimits) NeedsHelper() bool {
+	return rl.HasRlimits() || rl.HasCgroup()
+}
+
+// the rlimits, as resource=value pairs for the helper.
+func (rl *ResourceLimits) rlimitSpec() string {
+	var spec []string
+	if rl.CpuSeconds > 0 {
+		spec = append(spec, fmt.Sprintf("%d=%d", syscall.RLIMIT_CPU, rl.CpuSeconds))
+	}
+	if rl.AddressSpace > 0 {
+		spec = append(spec, fmt.Sprintf("%d=%d", syscall.RLIMIT_AS, uint64(rl.AddressSpace) * 1024 * 1024))
+	}
+	if rl.OpenFiles > 0 {
+		spec = append(spec, fmt.Sprintf("%d=%d", syscall.RLIMIT_NOFILE, rl.OpenFiles))
+	}
+	if rl.Processes > 0 {
+		spec = append(spec, fmt.Sprintf("%d=%d", RLIMIT_NPROC, rl.Processes))
+	}
+	return strings.Join(spec, " ")
+}
+
+// the pipes we use to talk to the exec helper.  goPipe releases the
+// helper, and statusPipe reports why it couldn't exec the score (or
+// EOF if it did).
+type helperPipes struct {
+	goPipe		*os.File
+	statusPipe	*os.File
+	// the helper's ends, which we close once it's started.
+	childFiles	[]*os.File
+}
+
+// Set up the process attributes to start the score via the exec helper.
+// Returns the helper's path and arguments.
+func setupHelper(rl *ResourceLimits, executable string, args []string, procenv *os.ProcAttr) (helper string, hargs []string, hp *helperPipes, err os.Error) {
+	gr, gw, err := os.Pipe()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sr, sw, err := os.Pipe()
+	if err != nil {
+		gr.Close()
+		gw.Close()
+		return "", nil, nil, err
+	}
+	hp = new(helperPipes)
+	hp.goPipe = gw
+	hp.statusPipe = sr
+	hp.childFiles = []*os.File{gr, sw}
+
+	goFd := len(procenv.Files)
+	procenv.Files = append(procenv.Files, gr, sw)
+	procenv.Env = peSetEnv(procenv.Env, helperRlimitsEnv, rl.rlimitSpec())
+	procenv.Env = peSetEnv(procenv.Env, helperFdsEnv, fmt.Sprintf("%d %d", goFd, goFd+1))
+
+	hargs = append(hargs, ExecHelperName, executable)
+	hargs = append(hargs, args...)
+
+	return "/proc/self/exe", hargs, hp, nil
+}
+
+// Close the helper's ends of the pipes, once it has its own copies (or
+// couldn't be started).  Must be called before Release or Abandon.
+func (hp *helperPipes) Started() {
+	for _, f := range hp.childFiles {
+		f.Close()
+	}
+}
+
+// Give up on the helper.  It'll exit once it sees the go pipe close.
+func (hp *helperPipes) Abandon() {
+	hp.goPipe.Close()
+	hp.statusPipe.Close()
+}
+
+// Let the helper go, and find out if it managed to exec the score.
+func (hp *helperPipes) Release() os.Error {
+	defer hp.statusPipe.Close()
+
+	hp.goPipe.Write([]byte{1})
+	hp.goPipe.Close()
+	msg, err := ioutil.ReadAll(hp.statusPipe)
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return os.NewError(string(msg))
+	}
+	return nil
+}
+
+// The exec helper.  Never returns.
+func execHelper() {
+	fds := strings.Fields(os.Getenv(helperFdsEnv))
+	if len(fds) != 2 || len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "exec helper: started without a score")
+		os.Exit(127)
+	}
+	goFd, _ := strconv.Atoi(fds[0])
+	statusFd, _ := strconv.Atoi(fds[1])
+	syscall.CloseOnExec(statusFd)
+
+	fail := func(msg string) {
+		syscall.Write(statusFd, []byte(msg))
+		os.Exit(127)
+	}
+
+	// wait for the player to put us in our cgroup.
+	buf := make([]byte, 1)
+	n, errno := syscall.Read(goFd, buf)
+	if n != 1 || errno != 0 {
+		fail("player went away")
+	}
+	syscall.Close(goFd)
+
+	// tidy up the environment for the score.
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, helperRlimitsEnv+"=") || strings.HasPrefix(kv, helperFdsEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	// the rlimits go on last, so we don't trip over them ourselves.
+	for _, kv := range strings.Fields(os.Getenv(helperRlimitsEnv)) {
+		parts := strings.SplitN(kv, "=", 2)
+		resource, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			fail("malformed rlimit \"" + kv + "\"")
+		}
+		value, err := strconv.Atoui64(parts[1])
+		if err != nil {
+			fail("malformed rlimit \"" + kv + "\"")
+		}
+		rlim := &syscall.Rlimit{value, value}
+		errno := syscall.Setrlimit(resource, rlim)
+		if errno != 0 {
+			fail("couldn't set rlimit " + kv + ": " + os.Errno(errno).String())
+		}
+	}
+
+	errno = syscall.Exec(os.Args[1], os.Args[2:], env)
+	fail("couldn't exec " + os.Args[1] + ": " + os.Errno(errno).String())
+}
+
+type ScoreCgroup struct {
+	path		string
+}
+
+// Create a cgroup for a job.
+func NewScoreCgroup(jobid uint64, rl *ResourceLimits) (cg *ScoreCgroup, err os.Error) {
+	cg = new(ScoreCgroup)
+	cg.path = path.Join(GetStringOpt("cgroup root"), fmt.Sprintf("job-%d", jobid))
+	err = os.Mkdir(cg.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	controls := map[string]string {
+		"memory.max":	rl.MemoryMax,
+		"cpu.max":	rl.CpuMax,
+		"pids.max":	rl.PidsMax,
+	}
+	for file, value := range controls {
+		if value == "" {
+			continue
+		}
+		err = cg.write(file, value)
+		if err != nil {
+			cg.Destroy()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+func (cg *ScoreCgroup) write(file, value string) os.Error {
+	return ioutil.WriteFile(path.Join(cg.path, file), []byte(value), 0644)
+}
+
+// read a flat keyed file (memory.events, cpu.stat) from the cgroup.
+func (cg *ScoreCgroup) readKeyed(file string) map[string]int64 {
+	values := make(map[string]int64)
+	data, err := ioutil.ReadFile(path.Join(cg.path, file))
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.Atoi64(fields[1])
+		if err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values
+}
+
+func (cg *ScoreCgroup) AddProcess(pid int) os.Error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// Note anything the cgroup did to the score in the response.
+func (cg *ScoreCgroup) Report(jobid uint64, resp *o.TaskResponse) {
+	events := cg.readKeyed("memory.events")
+	if events["oom_kill"] > 0 {
+		o.Warn("Job %d: Score was OOM killed", jobid)
+		resp.Response["oom_killed"] = strconv.Itoa64(events["oom_kill"])
+	}
+	stat := cg.readKeyed("cpu.stat")
+	if stat["nr_throttled"] > 0 {
+		o.Info("Job %d: Score was CPU throttled for %dus", jobid, stat["throttled_usec"])
+		resp.Response["cpu_throttled_usec"] = strconv.Itoa64(stat["throttled_usec"])
+	}
+}
+
+// Kill anything left in the cgroup, and remove it.
+func (cg *ScoreCgroup) Destroy() {
+	// cgroup.kill is fairly new, so don't worry if it's not there.
+	cg.write("cgroup.kill", "1")
+	for i := 0; i < cgroupRemoveAttempts; i++ {
+		err := os.Remove(cg.path)
+		if err == nil {
+			return
+		}
+		if i == cgroupRemoveAttempts - 1 {
+			o.Warn("Couldn't remove cgroup %s: %s", cg.path, err)
+			return
+		}
+		// give the stragglers a moment to die.
+		time.Sleep(cgroupRemoveDelay)
+	}
+}
@@ -0,0 +1,167 @@
+// output.go
+//
+// Keeping the end of a score's output.
+//
+// We hang on to the last 'output tail' kilobytes of whatever the score
+// writes to stdout and stderr, and send them back with the response so
+// there's some hope of working out what went wrong without logging in
+// to the player.  A response has to fit in a single wire packet, so
+// the tails are cut down further if they'd make it too big.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	o "orchestra"
+)
+
+const (
+	// the most we'll keep of each stream, in kilobytes, however big
+	// the output tail is set.  Two of these still leave plenty of
+	// room in a packet for everything else.
+	maxOutputTail		= 16
+
+	// how long we'll wait for the output once the score has gone.
+	outputDrainTimeout	= 5e9
+)
+
+type outputTail struct {
+	lock	sync.Mutex
+	limit	int
+	data	[]byte
+	// how many bytes we've thrown away from the front.
+	dropped	int64
+}
+
+func newOutputTail(limit int) *outputTail {
+	ot := new(outputTail)
+	ot.limit = limit
+
+	return ot
+}
+
+func (ot *outputTail) Write(p []byte) (n int, err os.Error) {
+	ot.lock.Lock()
+	defer ot.lock.Unlock()
+
+	ot.data = append(ot.data, p...)
+	if len(ot.data) > ot.limit {
+		cut := len(ot.data) - ot.limit
+		ot.dropped += int64(cut)
+		ot.data = append([]byte(nil), ot.data[cut:]...)
+	}
+	return len(p), nil
+}
+
+// the last limit bytes of the output, with a marker in front if
+// anything was left out.
+func (ot *outputTail) Text(limit int) string {
+	ot.lock.Lock()
+	defer ot.lock.Unlock()
+
+	data := ot.data
+	dropped := ot.dropped
+	if len(data) > limit {
+		dropped += int64(len(data) - limit)
+		data = data[len(data)-limit:]
+	}
+	// don't start part way through a UTF-8 sequence.
+	for len(data) > 0 && data[0] & 0xc0 == 0x80 {
+		data = data[1:]
+		dropped++
+	}
+	if dropped == 0 {
+		return string(data)
+	}
+	return fmt.Sprintf("[... %d bytes truncated ...]\n", dropped) + string(data)
+}
+
+// collects a score's output, and copies it into tails.
+type scoreOutput struct {
+	stdout	*outputTail
+	stderr	*outputTail
+	// closed as each reader finishes.
+	done	[]chan int
+	// the score's ends of the pipes, which we close once it has
+	// started.
+	childFiles	[]*os.File
+}
+
+func newScoreOutput(limit int) *scoreOutput {
+	so := new(scoreOutput)
+	so.stdout = newOutputTail(limit)
+	so.stderr = newOutputTail(limit)
+
+	return so
+}
+
+func (so *scoreOutput) Enabled() bool {
+	return so.stdout.limit > 0
+}
+
+func (so *scoreOutput) AddChildFile(f *os.File) {
+	so.childFiles = append(so.childFiles, f)
+}
+
+// Close the score's ends of the pipes, so the readers see EOF once it
+// has finished with them.  Safe to call more than once.
+func (so *scoreOutput) CloseChildFiles() {
+	for _, f := range so.childFiles {
+		f.Close()
+	}
+	so.childFiles = nil
+}
+
+// run a reader in its own goroutine, and keep track of when it's done.
+func (so *scoreOutput) Start(reader func()) {
+	done := make(chan int)
+	so.done = append(so.done, done)
+	go func() {
+		defer close(done)
+		reader()
+	}()
+}
+
+// copy everything from the pipe into the tail.
+func tailCopy(r *os.File, tail *outputTail) {
+	defer r.Close()
+
+	_, err := io.Copy(tail, r)
+	if err != nil {
+		o.Warn("tailCopy failed: %s", err)
+	}
+}
+
+// Wait for the output, but not forever - anything the score left
+// running in the background could hold the pipes open, and then put
+// the tails into the response.
+func (so *scoreOutput) Attach(resp *o.TaskResponse) {
+	if !so.Enabled() {
+		return
+	}
+	timeout := time.After(outputDrainTimeout)
+	for _, done := range so.done {
+		select {
+		case <-done:
+			continue
+		case <-timeout:
+		}
+		break
+	}
+
+	// make sure it'll still fit in a packet.
+	for limit := so.stdout.limit; limit > 0; limit /= 2 {
+		resp.Stdout = so.stdout.Text(limit)
+		resp.Stderr = so.stderr.Text(limit)
+		_, err := o.Encode(resp.Encode())
+		if err != o.ErrObjectTooLarge {
+			return
+		}
+	}
+	resp.Stdout = ""
+	resp.Stderr = ""
+}
@@ -0,0 +1,221 @@
+// params.go
+//
+// Parameter schemas.
+//
+// A score's .conf may declare the parameters the score takes, one per
+// line:
+//
+//	param host = string required regex:[a-z0-9.-]+
+//	param mode = string enum:fast,slow default:fast
+//	param count = int default:1
+//	param password = string required secret
+//
+// If a score declares any parameters, jobs for it are checked against
+// them before the score is run, and are refused if they don't fit.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const paramDeclPrefix = "param "
+
+type ParamSpec struct {
+	Name		string
+	// "string", "int" or "bool".
+	Type		string
+	Required	bool
+	// secret values are kept out of error messages, and can't be
+	// put on the command line.
+	Secret		bool
+	HasDefault	bool
+	Default		string
+	Regex		*regexp.Regexp
+	Enum		[]string
+}
+
+// in the order they were declared.
+type ParamSchema []*ParamSpec
+
+// Separate the parameter declarations from the rest of a score's
+// configuration.  They're replaced with blank lines so configureit's
+// line numbers still make sense.
+func splitParamDecls(conf string) (rest string, decls []string) {
+	lines := strings.Split(conf, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), paramDeclPrefix) {
+			decls = append(decls, strings.TrimSpace(line))
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n"), decls
+}
+
+func parseParamDecl(decl string) (spec *ParamSpec, err os.Error) {
+	bits := strings.SplitN(decl[len(paramDeclPrefix):], "=", 2)
+	if len(bits) != 2 {
+		return nil, os.NewError("missing '=' in \"" + decl + "\"")
+	}
+	spec = new(ParamSpec)
+	spec.Name = strings.TrimSpace(bits[0])
+	if spec.Name == "" {
+		return nil, os.NewError("empty parameter name")
+	}
+	for _, c := range spec.Name {
+		if !isParamNameChar(c) {
+			return nil, os.NewError("bad parameter name \"" + spec.Name + "\"")
+		}
+	}
+	words, err := splitQuotedWords(bits[1])
+	if err != nil {
+		return nil, os.NewError(spec.Name + ": " + err.String())
+	}
+	if len(words) == 0 {
+		return nil, os.NewError(spec.Name + ": no type given")
+	}
+	spec.Type = words[0]
+	switch spec.Type {
+	case "string", "int", "bool":
+	default:
+		return nil, os.NewError(spec.Name + ": unknown type \"" + spec.Type + "\"")
+	}
+	for _, word := range words[1:] {
+		switch {
+		case word == "required":
+			spec.Required = true
+		case word == "secret":
+			spec.Secret = true
+		case strings.HasPrefix(word, "default:"):
+			spec.HasDefault = true
+			spec.Default = word[len("default:"):]
+		case strings.HasPrefix(word, "regex:"):
+			// the whole value has to match.
+			spec.Regex, err = regexp.Compile("^(" + word[len("regex:"):] + ")$")
+			if err != nil {
+				return nil, os.NewError(spec.Name + ": bad regex: " + err.String())
+			}
+		case strings.HasPrefix(word, "enum:"):
+			spec.Enum = strings.Split(word[len("enum:"):], ",")
+		default:
+			return nil, os.NewError(spec.Name + ": unknown constraint \"" + word + "\"")
+		}
+	}
+	if spec.Required && spec.HasDefault {
+		return nil, os.NewError(spec.Name + ": a required parameter can't have a default")
+	}
+	if spec.HasDefault {
+		if msg := spec.check(spec.Default); msg != "" {
+			return nil, os.NewError(spec.Name + ": default " + msg)
+		}
+	}
+	return spec, nil
+}
+
+func ParseParamSchema(decls []string) (ps ParamSchema, err os.Error) {
+	seen := make(map[string]bool)
+	for _, decl := range decls {
+		spec, err := parseParamDecl(decl)
+		if err != nil {
+			return nil, err
+		}
+		if seen[spec.Name] {
+			return nil, os.NewError(spec.Name + ": declared twice")
+		}
+		seen[spec.Name] = true
+		ps = append(ps, spec)
+	}
+	return ps, nil
+}
+
+func (ps ParamSchema) Get(name string) *ParamSpec {
+	for _, spec := range ps {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// check a value against the spec.  Returns what's wrong with it, or ""
+// if it's fine.
+func (spec *ParamSpec) check(value string) string {
+	quoted := ""
+	if !spec.Secret {
+		quoted = fmt.Sprintf(" (\"%s\")", value)
+	}
+	switch spec.Type {
+	case "int":
+		if _, err := strconv.Atoi64(value); err != nil {
+			return "isn't an integer" + quoted
+		}
+	case "bool":
+		if _, err := strconv.Atob(value); err != nil {
+			return "isn't true or false" + quoted
+		}
+	}
+	if nil != spec.Enum {
+		found := false
+		for _, e := range spec.Enum {
+			if e == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "isn't one of " + strings.Join(spec.Enum, ", ") + quoted
+		}
+	}
+	if nil != spec.Regex && !spec.Regex.MatchString(value) {
+		return "doesn't match the allowed pattern" + quoted
+	}
+	return ""
+}
+
+// Check a job's parameters against the schema, filling in any defaults.
+// Returns a message for each parameter that's wrong, or nil if they're
+// all fine.  A score without a schema takes anything.
+func (ps ParamSchema) Validate(params map[string]string) (errors map[string]string) {
+	if len(ps) == 0 {
+		return nil
+	}
+	errors = make(map[string]string)
+	for k, _ := range params {
+		if ps.Get(k) == nil {
+			errors[k] = "unknown parameter"
+		}
+	}
+	for _, spec := range ps {
+		value, exists := params[spec.Name]
+		if !exists {
+			switch {
+			case spec.Required:
+				errors[spec.Name] = "is required"
+			case spec.HasDefault:
+				params[spec.Name] = spec.Default
+			}
+			continue
+		}
+		if msg := spec.check(value); msg != "" {
+			errors[spec.Name] = msg
+		}
+	}
+	if len(errors) == 0 {
+		return nil
+	}
+	return errors
+}
+
+// the names of the parameters in errors, in order.
+func paramErrorNames(errors map[string]string) (names []string) {
+	for k, _ := range errors {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
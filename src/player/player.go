@@ -40,20 +40,63 @@ var (
 	pendingQueue		= list.New()
 	unacknowledgedQueue	= list.New()
 	newConnection		= make(chan *NewConnectionInfo)
-	pendingTaskRequest	= false
+	// how many ReadyForTasks the conductor hasn't answered yet.
+	requestedTasks		= 0
 )
 
+// the number of jobs we can run at once.
+func playerSlots() int {
+	slots := GetIntOpt("slots")
+	if slots < 1 {
+		slots = 1
+	}
+	return slots
+}
+
+// get the first pending job whose score has a slot free.
 func getNextPendingJob() (job *o.JobRequest) {
-	e := pendingQueue.Front()
-	if e != nil {
+	for e := pendingQueue.Front(); e != nil; e = e.Next() {
 		job, _ = e.Value.(*o.JobRequest)
-		pendingQueue.Remove(e)
+		if CanRunScore(job.Score) {
+			pendingQueue.Remove(e)
+			return job
+		}
 	}
-	return job
+	return nil
+}
+
+// how many of the pending jobs could be started now.  The rest are
+// waiting for their score's own slots rather than the player's, so they
+// shouldn't stop us asking for other work.
+func runnablePendingCount() (n int) {
+	starting := make(map[string]int)
+	for e := pendingQueue.Front(); e != nil; e = e.Next() {
+		job := e.Value.(*o.JobRequest)
+		if scoreHasRoom(job.Score, starting[job.Score]) {
+			starting[job.Score]++
+			n++
+		}
+	}
+	return n
+}
+
+// remove a job from the pending queue.  Returns false if the job
+// wasn't waiting.
+func removePendingJob(id uint64) bool {
+	for e := pendingQueue.Front(); e != nil; e = e.Next() {
+		job := e.Value.(*o.JobRequest)
+		if job.Id == id {
+			pendingQueue.Remove(e)
+			return true
+		}
+	}
+	return false
 }
 
 func appendPendingJob(job *o.JobRequest) {
-	pendingTaskRequest = false
+	if requestedTasks > 0 {
+		requestedTasks--
+	}
 	pendingQueue.PushBack(job)
 }
 
@@ -152,6 +195,44 @@ func handleRequest(c net.Conn, message interface{}) {
 	}
 }
 
+func handleCancel(c net.Conn, message interface{}) {
+	o.Debug("Cancel Received")
+	ct, ok := message.(*o.ProtoCancelTask)
+	if !ok {
+		o.Assert("CC stuffed up - handleCancel got something that wasn't a ProtoCancelTask.")
+	}
+	id := *ct.Id
+	existing := o.JobGet(id)
+	if nil == existing {
+		// we've never seen this job.  Remember that it's been
+		// cancelled so we don't run it if the request turns up late.
+		job := o.NewJobRequest()
+		job.Id = id
+		job.MyResponse = o.NewTaskResponse()
+		job.MyResponse.Id = id
+		job.MyResponse.State = o.RESP_CANCELLED
+		o.JobAdd(job)
+		o.Info("job%d: Cancelled before it arrived", id)
+		sendResponse(c, job.MyResponse)
+		return
+	}
+	if existing.MyResponse.IsFinished() {
+		// too late, it's done.  Let the conductor have the real result.
+		o.Debug("job%d: Already finished, resending Response", id)
+		sendResponse(c, existing.MyResponse)
+		return
+	}
+	if removePendingJob(id) {
+		o.Info("job%d: Cancelled before execution", id)
+		existing.MyResponse.State = o.RESP_CANCELLED
+		sendResponse(c, existing.MyResponse)
+		return
+	}
+	if AbortJob(id) {
+		o.Info("job%d: Cancelling execution", id)
+	}
+}
+
 func handleAck(c net.Conn, message interface{}) {
 	o.Debug("Ack Received")
 	ack, ok := message.(*o.ProtoAcknowledgement)
@@ -160,6 +241,9 @@ func handleAck(c net.Conn, message interface{}) {
 	}
 	if ack.Id != nil {
 		acknowledgeResponse(*ack.Id)
+		// the conductor has our result, so the job is now
+		// finished as far as retention is concerned.
+		o.JobMarkFinished(*ack.Id)
 	}
 }
 
@@ -168,6 +252,7 @@ var dispatcher	= map[uint8] func(net.Conn, interface{}) {
 	o.TypeNop:		handleNop,
 	o.TypeTaskRequest:	handleRequest,
 	o.TypeAcknowledgement:	handleAck,
+	o.TypeCancelTask:	handleCancel,
 
 	/* P->C only messages, should never appear on the wire to us. */
 	o.TypeIdentifyClient:	handleIllegal,
@@ -226,7 +311,7 @@ func connectMe(initialDelay int64) {
 func ProcessingLoop() {
 	var	conn			net.Conn		= nil
 	var     nextRetryResp		*o.TaskResponse 	= nil
-	var	jobCompletionChan	<-chan *o.TaskResponse	= nil
+	var	jobCompletionChan	= make(chan *o.TaskResponse)
 	var	connectDelay		int64			= 0
 	var	doScoreReload		bool			= false
 	// kick off a new connection attempt.
@@ -253,24 +338,32 @@ func ProcessingLoop() {
 				retryChan = time.After(retryDelay)
 			}
 		}
-		if jobCompletionChan == nil {
+		// fill as many slots as we can, and ask for work for the
+		// rest - one ReadyForTask per free slot.  Nothing new is
+		// started whilst a score reload is waiting for things to
+		// settle down.
+		slots := playerSlots()
+		for !doScoreReload && RunningJobCount() < slots {
 			nextJob := getNextPendingJob()
-			if nextJob != nil {
-				jobCompletionChan = ExecuteJob(nextJob)
-			} else {
-				if conn != nil && !pendingTaskRequest {
-					o.Debug("Asking for trouble")
-					p := o.MakeReadyForTask()
-					p.Send(conn)
-					o.Debug("Sent Request for trouble")
-					pendingTaskRequest = true
-				}
+			if nextJob == nil {
+				break
+			}
+			ExecuteJob(nextJob, jobCompletionChan)
+		}
+		if conn != nil {
+			free := slots - RunningJobCount() - runnablePendingCount() - requestedTasks
+			for ; free > 0; free-- {
+				o.Debug("Asking for trouble")
+				p := o.MakeReadyForTask()
+				p.Send(conn)
+				requestedTasks++
 			}
 		}
 		select {
-		// Currently executing job finishes.
+		// An executing job finishes.
 		case newresp := <- jobCompletionChan:
 			o.Debug("Job %d has completed with State %d\n", newresp.Id, newresp.State)
+			JobCompleted(newresp.Id)
 			// preemptively set a retrytime.
 			newresp.RetryTime = time.Nanoseconds()
 			// ENOCONN - sub it in as our next retryresponse, and prepend the old one onto the queue.
@@ -284,12 +377,11 @@ func ProcessingLoop() {
 				o.Debug("job%d: Sending Initial Response", newresp.Id)
 				sendResponse(conn, newresp)
 			}
-			if doScoreReload {
+			if doScoreReload && RunningJobCount() == 0 {
 				o.Info("Performing Deferred score reload")
 				LoadScores()
 				doScoreReload = false
 			}
-			jobCompletionChan = nil
 		// If the current unacknowledged response needs a retry, send it.
 		case <-retryChan:
 			sendResponse(conn, nextRetryResp)
@@ -301,7 +393,7 @@ func ProcessingLoop() {
 			}
 			conn = nci.conn
 			connectDelay = nci.timeout
-			pendingTaskRequest = false
+			requestedTasks = 0
 
 			// start the reader
 			go Reader(conn)
@@ -341,7 +433,7 @@ func ProcessingLoop() {
 			// fortunately this is actually completely safe as 
 			// long as nobody's currently executing.
 			// who'd have thunk it?
-			if jobCompletionChan == nil {
+			if RunningJobCount() == 0 {
 				o.Info("Reloading scores")
 				LoadScores()
 			} else {
@@ -360,12 +452,33 @@ func ProcessingLoop() {
 	}
 }
 
+const ExpiryInterval = 60e9 // check for expired jobs every minute.
+
+// Evict old jobs from our registry according to the retention policy.
+func expiryLoop() {
+	for {
+		maxAge := int64(GetIntOpt("job retention age")) * 1e9
+		maxCount := GetIntOpt("job retention count")
+		ids := o.JobExpire(maxAge, maxCount)
+		if len(ids) > 0 {
+			o.Info("Expired %d jobs", len(ids))
+		}
+		time.Sleep(ExpiryInterval)
+	}
+}
+
 func main() {
+	// are we starting a score for another player?
+	if len(os.Args) > 0 && os.Args[0] == ExecHelperName {
+		execHelper()
+	}
+
 	o.SetLogName("player")
 
 	flag.Parse()
 
 	ConfigLoad()
 	LoadScores()
+	go expiryLoop()
 	ProcessingLoop()
 }
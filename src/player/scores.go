@@ -11,6 +11,7 @@ package main
 import (
 	"os"
 	"io"
+	"io/ioutil"
 	"strings"
 	o "orchestra"
 	"path"
@@ -24,6 +25,23 @@ type ScoreInfo struct {
 	InitialEnv	map[string]string
 
 	Interface	string
+	// the command line template for the args interface.
+	ArgsTemplate	string
+	Args		ArgTemplate
+	// the parameters the score takes, as declared in its .conf.
+	ParamDecls	[]string
+	Params		ParamSchema
+	// who to run the score as.  User is "" for the player's default.
+	User		string
+	Group		string
+	// the most instances of the score that may run at once, or 0
+	// for no limit beyond the player's slots.
+	Slots		int
+	// how long (in seconds) the score may run before it's killed,
+	// or 0 for no limit.
+	Timeout		int
+	// rlimits and cgroup controls for the score's process.
+	Limits		*ResourceLimits
 
 	Config		*configureit.Config
 }
@@ -36,7 +54,6 @@ type ScoreExecution struct {
 
 func NewScoreInfo() (si *ScoreInfo) {
 	si = new (ScoreInfo)
-	si.InitialEnv = make(map[string]string)
 
 	config := NewScoreInfoConfig()
 	si.updateFromConfig(config)
@@ -48,28 +65,102 @@ func NewScoreInfoConfig() (config *configureit.Config) {
 	config = configureit.New()
 
 	config.Add("interface", configureit.NewStringOption("env"))
+	config.Add("args", configureit.NewStringOption(""))
 	config.Add("dir", configureit.NewStringOption(""))
-	config.Add("path", configureit.NewStringOption("/usr/bin:/bin"))
-	config.Add("user", configureit.NewUserOption(""))
+	config.Add("path", configureit.NewStringOption("/usr/bin:/usr/sbin:/bin:/sbin"))
+	// extra environment variables, as space separated KEY=value
+	// pairs.
+	config.Add("env", configureit.NewStringOption(""))
+	// users and groups are only looked up when the score is run, so
+	// one that's missing fails the job rather than the player.
+	config.Add("user", configureit.NewStringOption(""))
+	config.Add("group", configureit.NewStringOption(""))
+	config.Add("slots", configureit.NewIntOption(0))
+	config.Add("timeout", configureit.NewIntOption(0))
+	config.Add("rlimit cpu", configureit.NewIntOption(0))
+	config.Add("rlimit as", configureit.NewIntOption(0))
+	config.Add("rlimit nofile", configureit.NewIntOption(0))
+	config.Add("rlimit nproc", configureit.NewIntOption(0))
+	config.Add("cgroup memory max", configureit.NewStringOption(""))
+	config.Add("cgroup cpu max", configureit.NewStringOption(""))
+	config.Add("cgroup pids max", configureit.NewStringOption(""))
 
 	return config
 }
 
 func (si *ScoreInfo) updateFromConfig(config *configureit.Config) {
-	// propogate PATH overrides.
-	opt := config.Get("dir")
+	// propogate PATH overrides, and any other environment.
+	si.InitialEnv = make(map[string]string)
+	opt := config.Get("path")
 	sopt, _ := opt.(*configureit.StringOption)
-	si.InitialEnv["PATH"] = sopt.Value
+	si.InitialEnv["PATH"] = strings.TrimSpace(sopt.Value)
+	opt = config.Get("env")
+	sopt, _ = opt.(*configureit.StringOption)
+	for _, kv := range strings.Fields(sopt.Value) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			o.Warn("Score %s: Ignoring malformed env entry \"%s\"", si.Name, kv)
+			continue
+		}
+		si.InitialEnv[parts[0]] = parts[1]
+	}
 
 	// set the interface type.
 	opt = config.Get("interface")
 	sopt, _ = opt.(*configureit.StringOption)
 	si.Interface = sopt.Value
 
+	// and the argument template
+	opt = config.Get("args")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.ArgsTemplate = strings.TrimSpace(sopt.Value)
+
 	// propogate initial Pwd
 	opt = config.Get("dir")
 	sopt, _ = opt.(*configureit.StringOption)
-	si.InitialPwd = sopt.Value	
+	si.InitialPwd = strings.TrimSpace(sopt.Value)
+
+	// propogate the user and group
+	opt = config.Get("user")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.User = strings.TrimSpace(sopt.Value)
+	opt = config.Get("group")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.Group = strings.TrimSpace(sopt.Value)
+
+	// concurrency limit
+	opt = config.Get("slots")
+	iopt, _ := opt.(*configureit.IntOption)
+	si.Slots = iopt.Value
+
+	// execution time limit
+	opt = config.Get("timeout")
+	iopt, _ = opt.(*configureit.IntOption)
+	si.Timeout = iopt.Value
+
+	// resource limits
+	si.Limits = new(ResourceLimits)
+	opt = config.Get("rlimit cpu")
+	iopt, _ = opt.(*configureit.IntOption)
+	si.Limits.CpuSeconds = iopt.Value
+	opt = config.Get("rlimit as")
+	iopt, _ = opt.(*configureit.IntOption)
+	si.Limits.AddressSpace = iopt.Value
+	opt = config.Get("rlimit nofile")
+	iopt, _ = opt.(*configureit.IntOption)
+	si.Limits.OpenFiles = iopt.Value
+	opt = config.Get("rlimit nproc")
+	iopt, _ = opt.(*configureit.IntOption)
+	si.Limits.Processes = iopt.Value
+	opt = config.Get("cgroup memory max")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.Limits.MemoryMax = strings.TrimSpace(sopt.Value)
+	opt = config.Get("cgroup cpu max")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.Limits.CpuMax = strings.TrimSpace(sopt.Value)
+	opt = config.Get("cgroup pids max")
+	sopt, _ = opt.(*configureit.StringOption)
+	si.Limits.PidsMax = strings.TrimSpace(sopt.Value)
 }
 
 var (
@@ -77,10 +168,16 @@ var (
 )
 
 func ScoreConfigure(si *ScoreInfo, r io.Reader) {
+	data, err := ioutil.ReadAll(r)
+	o.MightFail(err, "Error Reading Score Configuration for %s", si.Name)
+	// configureit doesn't know about the parameter declarations, so
+	// we take those out first.
+	rest, decls := splitParamDecls(string(data))
 	config := NewScoreInfoConfig()
-	err := config.Read(r, 1)
+	err = config.Read(strings.NewReader(rest), 1)
 	o.MightFail(err, "Error Parsing Score Configuration for %s", si.Name)
 	si.updateFromConfig(config)
+	si.ParamDecls = decls
 }
 
 func LoadScores() {
@@ -128,6 +225,40 @@ func LoadScores() {
 			} else {
 				o.Warn("Couldn't open config file for %s, assuming defaults: %s", files[i].Name, err)
 			}
+			if si.InitialPwd != "" {
+				if !path.IsAbs(si.InitialPwd) {
+					o.Warn("Rejecting %s: dir \"%s\" isn't an absolute path", files[i].Name, si.InitialPwd)
+					continue
+				}
+				fi, err := os.Stat(si.InitialPwd)
+				if err != nil || !fi.IsDirectory() {
+					o.Warn("Rejecting %s: dir \"%s\" isn't a directory", files[i].Name, si.InitialPwd)
+					continue
+				}
+			}
+			si.Args, err = ParseArgTemplate(si.ArgsTemplate)
+			if err != nil {
+				o.Warn("Rejecting %s: bad args template: %s", files[i].Name, err)
+				continue
+			}
+			si.Params, err = ParseParamSchema(si.ParamDecls)
+			if err != nil {
+				o.Warn("Rejecting %s: bad parameter declaration: %s", files[i].Name, err)
+				continue
+			}
+			// secrets don't belong where ps can see them.
+			badArg := ""
+			for _, name := range si.Args.Params() {
+				spec := si.Params.Get(name)
+				if nil != spec && spec.Secret {
+					badArg = name
+					break
+				}
+			}
+			if badArg != "" {
+				o.Warn("Rejecting %s: secret parameter %s is used in the args template", files[i].Name, badArg)
+				continue
+			}
 			Scores[files[i].Name] = si
 		}
 	}
@@ -19,10 +19,19 @@ type JobRequest struct {
 	Players	[]string
 	Scope	string
 	Params	map[string]string
+	Batch	*string
+	FailureBudget	*int
+	Priority	int
+	RunTimeout	*int
 }
 
 var (
 	AllOf	     = flag.Bool("all-of", false, "Send request to all named players")
+	Scope	     = flag.String("scope", "", "Job scope (one, all, any:N, quorum:N or quorum:P%).  Overrides -all-of")
+	Batch	     = flag.String("batch", "", "Roll the job out this many (or this percentage of) players at a time")
+	FailureBudget = flag.Int("failure-budget", 0, "Failures to tolerate before halting a rolling job")
+	Priority     = flag.Int("priority", 0, "Job priority.  Higher runs first")
+	RunTimeout   = flag.Int("timeout", 0, "Kill the score if it runs for longer than this many seconds")
 	AudienceSock = flag.String("audience-sock", "/var/run/conductor.sock", "Path for the audience submission socket")
 )
 
@@ -53,11 +62,21 @@ func main() {
 	jr := NewJobRequest()
 	jr.Op = "queue"
 	jr.Score = args[0]
-	if *AllOf {
+	if *Scope != "" {
+		jr.Scope = *Scope
+	} else if *AllOf {
 		jr.Scope = "all"
 	} else {
 		jr.Scope = "one"
 	}
+	jr.Priority = *Priority
+	if *RunTimeout > 0 {
+		jr.RunTimeout = RunTimeout
+	}
+	if *Batch != "" {
+		jr.Batch = Batch
+		jr.FailureBudget = FailureBudget
+	}
 
 	var k int
 	for k = 1; k < len(args); k++ {